@@ -0,0 +1,127 @@
+package cdn
+
+import (
+	"github.com/BakerHub/trivial/fs"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// DirectoryUploader mirrors the uploaded files into a directory, the root of a self-hosted static origin or a
+// mounted network path.
+//
+// Every file is written to a temporary file renamed into place, so the origin never serves a partial file. A
+// file already in the directory with the same content is skipped.
+type DirectoryUploader struct {
+	target       string
+	skipSuffixes []string
+}
+
+type DirectoryUploaderOption func(*DirectoryUploader)
+
+// NewDirectoryUploader creates an uploader copying the files under target.
+func NewDirectoryUploader(target string, opts ...DirectoryUploaderOption) *DirectoryUploader {
+	d := &DirectoryUploader{
+		target:       target,
+		skipSuffixes: defaultSkipSuffixes,
+	}
+
+	for _, opt := range opts {
+		opt(d)
+	}
+
+	return d
+}
+
+// DirectoryIgnoreSuffixes is IgnoreSuffixes for a DirectoryUploader.
+func DirectoryIgnoreSuffixes(suffixes ...string) DirectoryUploaderOption {
+	all := withDefaultSuffixes(suffixes)
+
+	return func(d *DirectoryUploader) {
+		d.skipSuffixes = all
+	}
+}
+
+// Upload copies the files under directory to target/prefix, it returns an *UploadError per failed file.
+func (d *DirectoryUploader) Upload(directory string, prefix string) []error {
+	_, errs := d.UploadWithSummary(directory, prefix)
+	return errs
+}
+
+// UploadWithSummary is Upload also returning the keys uploaded, skipped and failed.
+func (d *DirectoryUploader) UploadWithSummary(directory string, prefix string) (*UploadSummary, []error) {
+	summary := &UploadSummary{}
+	files, err := stagedFiles(directory, prefix, d.skipSuffixes)
+	if err != nil {
+		return summary, []error{err}
+	}
+
+	var errs []error
+	for _, f := range files {
+		dst := filepath.Join(d.target, filepath.FromSlash(f.key))
+		if sameContent(f.path, dst, f.size) {
+			summary.Skipped = append(summary.Skipped, f.key)
+			continue
+		}
+
+		if err := writeAtomic(f.path, dst); err != nil {
+			summary.Failed = append(summary.Failed, f.key)
+			errs = append(errs, &UploadError{Path: f.path, Key: f.key, Err: err})
+			continue
+		}
+		summary.Uploaded = append(summary.Uploaded, f.key)
+	}
+	return summary, errs
+}
+
+// sameContent tells whether dst is a regular file with the content of src, whose size is size. The files are
+// only hashed when their sizes match.
+func sameContent(src string, dst string, size int64) bool {
+	info, err := os.Stat(dst)
+	if err != nil || !info.Mode().IsRegular() || info.Size() != size {
+		return false
+	}
+
+	hash := fs.NewFileHashSHA256()
+	srcHash, err := hash.FromFile(src)
+	if err != nil {
+		return false
+	}
+	dstHash, err := hash.FromFile(dst)
+	return err == nil && srcHash == dstHash
+}
+
+// writeAtomic copies src to a temporary file next to dst and renames it to dst.
+func writeAtomic(src string, dst string) error {
+	in, err := os.Open(src) // #nosec
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	if err := os.MkdirAll(filepath.Dir(dst), os.ModePerm); err != nil {
+		return err
+	}
+	out, err := ioutil.TempFile(filepath.Dir(dst), "."+filepath.Base(dst)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(out.Name())
+
+	_, err = io.Copy(out, in)
+	if err == nil {
+		err = out.Sync()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		// TempFile creates the file readable by its owner only, the origin server needs to read it
+		err = os.Chmod(out.Name(), 0644)
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(out.Name(), dst)
+}
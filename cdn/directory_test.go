@@ -0,0 +1,116 @@
+package cdn
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/BakerHub/trivial/fs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	for name, content := range files {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		require.NoError(t, os.MkdirAll(filepath.Dir(p), os.ModePerm))
+		require.NoError(t, ioutil.WriteFile(p, []byte(content), 0644))
+	}
+}
+
+func TestDirectoryUploader_Upload(t *testing.T) {
+	cases := map[string]struct {
+		options  []DirectoryUploaderOption
+		files    map[string]string
+		existing map[string]string
+
+		want    map[string]string
+		summary *UploadSummary
+		failed  int
+	}{
+		"copy": {
+			nil,
+			map[string]string{"ab/cd.js": "js", "ef.css": "css", ".DS_Store": "skip"},
+			nil,
+			map[string]string{"p/ab/cd.js": "js", "p/ef.css": "css"},
+			&UploadSummary{Uploaded: []string{"p/ab/cd.js", "p/ef.css"}},
+			0,
+		},
+		"skip existing": {
+			[]DirectoryUploaderOption{DirectoryIgnoreSuffixes(".map")},
+			map[string]string{"a.js": "same", "b.js": "longer", "c.js": "new", "b.js.map": "map"},
+			map[string]string{"p/a.js": "same", "p/b.js": "short", "p/c.js": "old"},
+			map[string]string{"p/a.js": "same", "p/b.js": "longer", "p/c.js": "new"},
+			&UploadSummary{Uploaded: []string{"p/b.js", "p/c.js"}, Skipped: []string{"p/a.js"}},
+			0,
+		},
+		"directory in the way": {
+			nil,
+			map[string]string{"a.js": "a", "b.js": "b"},
+			map[string]string{"p/a.js/c": "c"},
+			map[string]string{"p/a.js/c": "c", "p/b.js": "b"},
+			&UploadSummary{Uploaded: []string{"p/b.js"}, Failed: []string{"p/a.js"}},
+			1,
+		},
+	}
+
+	for name, tc := range cases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "directory")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+			stage := filepath.Join(dir, "stage")
+			target := filepath.Join(dir, "target")
+			writeFiles(t, stage, tc.files)
+			writeFiles(t, target, tc.existing)
+
+			d := NewDirectoryUploader(target, tc.options...)
+			summary, errs := d.UploadWithSummary(stage, "p")
+
+			assert.Equal(t, tc.summary, summary)
+			assert.Len(t, errs, tc.failed)
+			for _, err := range errs {
+				assert.IsType(t, &UploadError{}, err)
+			}
+			got := map[string]string{}
+			for _, p := range fs.ListDirectory(target) {
+				rel, err := filepath.Rel(target, p)
+				require.NoError(t, err)
+				content, err := ioutil.ReadFile(p)
+				require.NoError(t, err)
+				got[filepath.ToSlash(rel)] = string(content)
+				if runtime.GOOS != "windows" {
+					info, err := os.Stat(p)
+					require.NoError(t, err)
+					assert.Equal(t, os.FileMode(0644), info.Mode().Perm(), rel)
+				}
+			}
+			assert.Equal(t, tc.want, got, "no temporary file is left")
+		})
+	}
+}
+
+func TestSpace_Push_directory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "space")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	target := filepath.Join(dir, "origin")
+	writeFiles(t, dir, map[string]string{"app.js": "normal"})
+
+	s := NewSpace(NewDirectoryUploader(target), "static", StageDirectory(filepath.Join(dir, "stage")))
+	cdnPath, err := s.Stage(filepath.Join(dir, "app.js"))
+	require.NoError(t, err)
+
+	assert.Empty(t, s.Push())
+	assert.Equal(t, "normal", mustRead(t, filepath.Join(target, cdnPath)))
+	assert.Empty(t, s.Push(), "pushing again skips the files")
+}
+
+func mustRead(t *testing.T, path string) string {
+	content, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	return string(content)
+}
@@ -0,0 +1,269 @@
+package cdn
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1" // #nosec
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultKodoEndpoint is the upload endpoint of the Kodo buckets of the East China region.
+	DefaultKodoEndpoint = "https://upload.qiniup.com"
+
+	// kodoBlockSize is the size of the blocks of a resumable upload, fixed by the Kodo API.
+	kodoBlockSize = 4 << 20
+)
+
+// KodoUploader uploads files to a Qiniu Kodo bucket through its upload API, without qshell.
+//
+// Files up to the form limit are sent in a single form upload, larger ones in 4MB blocks of a resumable upload.
+type KodoUploader struct {
+	accessKey    string
+	secretKey    string
+	bucket       string
+	endpoint     string
+	client       *http.Client
+	formLimit    int64
+	chunkSize    int64
+	blockSize    int64
+	tokenTTL     time.Duration
+	skipSuffixes []string
+}
+
+type KodoUploaderOption func(*KodoUploader)
+
+// NewKodoUploader creates an uploader to bucket signing its upload tokens with the access and secret keys.
+func NewKodoUploader(accessKey string, secretKey string, bucket string, opts ...KodoUploaderOption) *KodoUploader {
+	k := &KodoUploader{
+		accessKey:    accessKey,
+		secretKey:    secretKey,
+		bucket:       bucket,
+		endpoint:     DefaultKodoEndpoint,
+		client:       http.DefaultClient,
+		formLimit:    kodoBlockSize,
+		chunkSize:    kodoBlockSize,
+		blockSize:    kodoBlockSize,
+		tokenTTL:     time.Hour,
+		skipSuffixes: defaultSkipSuffixes,
+	}
+
+	for _, opt := range opts {
+		opt(k)
+	}
+
+	return k
+}
+
+// KodoEndpoint sets the upload endpoint, the one of the region of the bucket.
+func KodoEndpoint(endpoint string) KodoUploaderOption {
+	return func(k *KodoUploader) {
+		k.endpoint = strings.TrimSuffix(endpoint, "/")
+	}
+}
+
+// KodoClient sets the http client sending the requests.
+func KodoClient(client *http.Client) KodoUploaderOption {
+	return func(k *KodoUploader) {
+		k.client = client
+	}
+}
+
+// KodoFormLimit sets the size of the largest file sent in a form upload, 4MB by default.
+func KodoFormLimit(size int64) KodoUploaderOption {
+	return func(k *KodoUploader) {
+		k.formLimit = size
+	}
+}
+
+// KodoChunkSize sets the size of the requests of a resumable upload, it is at most the 4MB of a block.
+func KodoChunkSize(size int64) KodoUploaderOption {
+	return func(k *KodoUploader) {
+		if size > 0 && size < kodoBlockSize {
+			k.chunkSize = size
+		}
+	}
+}
+
+// KodoIgnoreSuffixes is IgnoreSuffixes for a KodoUploader.
+func KodoIgnoreSuffixes(suffixes ...string) KodoUploaderOption {
+	all := withDefaultSuffixes(suffixes)
+
+	return func(k *KodoUploader) {
+		k.skipSuffixes = all
+	}
+}
+
+// KodoError is an error response of the Kodo API.
+type KodoError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *KodoError) Error() string {
+	return fmt.Sprintf("kodo: %d %s", e.StatusCode, e.Message)
+}
+
+// kodoChunk is the response to a chunk of a resumable upload.
+type kodoChunk struct {
+	Ctx    string `json:"ctx"`
+	Crc32  uint32 `json:"crc32"`
+	Offset int64  `json:"offset"`
+}
+
+// kodoFile is the response to a completed upload.
+type kodoFile struct {
+	Hash string `json:"hash"`
+	Key  string `json:"key"`
+}
+
+// Upload uploads the files under directory to keys under prefix, it returns an *UploadError per failed file.
+func (k *KodoUploader) Upload(directory string, prefix string) []error {
+	return uploadFiles(directory, prefix, k.skipSuffixes, k.UploadFile)
+}
+
+// UploadFile uploads localFile to key, replacing the file of the bucket if any.
+func (k *KodoUploader) UploadFile(localFile string, key string) error {
+	file, err := os.Open(localFile) // #nosec
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	token := k.uploadToken(key, time.Now().Add(k.tokenTTL))
+	var result kodoFile
+	if info.Size() <= k.formLimit {
+		err = k.formUpload(file, key, token, &result)
+	} else {
+		err = k.resumableUpload(file, info.Size(), key, token, &result)
+	}
+	if err != nil {
+		return err
+	}
+	if result.Key != key {
+		return fmt.Errorf("kodo: uploaded to %q instead of %q", result.Key, key)
+	}
+	return nil
+}
+
+// uploadToken signs the put policy allowing to upload key until deadline.
+func (k *KodoUploader) uploadToken(key string, deadline time.Time) string {
+	policy, _ := json.Marshal(struct {
+		Scope    string `json:"scope"`
+		Deadline int64  `json:"deadline"`
+	}{k.bucket + ":" + key, deadline.Unix()})
+
+	encodedPolicy := base64.URLEncoding.EncodeToString(policy)
+	mac := hmac.New(sha1.New, []byte(k.secretKey))
+	_, _ = mac.Write([]byte(encodedPolicy))
+	sign := base64.URLEncoding.EncodeToString(mac.Sum(nil))
+
+	return k.accessKey + ":" + sign + ":" + encodedPolicy
+}
+
+func (k *KodoUploader) formUpload(file io.Reader, key string, token string, result *kodoFile) error {
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	_ = form.WriteField("token", token)
+	_ = form.WriteField("key", key)
+	part, err := form.CreateFormFile("file", path.Base(key))
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(part, file); err != nil {
+		return err
+	}
+	if err := form.Close(); err != nil {
+		return err
+	}
+
+	return k.post(k.endpoint+"/", "", form.FormDataContentType(), &body, result)
+}
+
+// resumableUpload sends file in blocks made of one mkblk and some bput chunks, then joins them with mkfile.
+func (k *KodoUploader) resumableUpload(file io.Reader, size int64, key string, token string, result *kodoFile) error {
+	var contexts []string
+	buf := make([]byte, k.chunkSize)
+	for offset := int64(0); offset < size; offset += k.blockSize {
+		blockLen := min64(k.blockSize, size-offset)
+
+		var ctx string
+		for written := int64(0); written < blockLen; {
+			chunk := buf[:min64(k.chunkSize, blockLen-written)]
+			if _, err := io.ReadFull(file, chunk); err != nil {
+				return err
+			}
+
+			url := fmt.Sprintf("%s/mkblk/%d", k.endpoint, blockLen)
+			if written > 0 {
+				url = fmt.Sprintf("%s/bput/%s/%d", k.endpoint, ctx, written)
+			}
+			var resp kodoChunk
+			if err := k.post(url, token, "application/octet-stream", bytes.NewReader(chunk), &resp); err != nil {
+				return err
+			}
+			if resp.Crc32 != crc32.ChecksumIEEE(chunk) {
+				return fmt.Errorf("kodo: crc32 mismatch for the chunk at %d", offset+written)
+			}
+
+			ctx = resp.Ctx
+			written += int64(len(chunk))
+		}
+		contexts = append(contexts, ctx)
+	}
+
+	url := fmt.Sprintf("%s/mkfile/%d/key/%s", k.endpoint, size, base64.URLEncoding.EncodeToString([]byte(key)))
+	return k.post(url, token, "text/plain", strings.NewReader(strings.Join(contexts, ",")), result)
+}
+
+// post sends body to url and decodes the JSON response to result, token is set for the resumable uploads.
+func (k *KodoUploader) post(url string, token string, contentType string, body io.Reader, result interface{}) error {
+	req, err := http.NewRequest(http.MethodPost, url, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	if len(token) > 0 {
+		req.Header.Set("Authorization", "UpToken "+token)
+	}
+
+	resp, err := k.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var e struct {
+			Error string `json:"error"`
+		}
+		_ = json.NewDecoder(resp.Body).Decode(&e)
+		if len(e.Error) == 0 {
+			e.Error = http.StatusText(resp.StatusCode)
+		}
+		return &KodoError{StatusCode: resp.StatusCode, Message: e.Error}
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
+
+func min64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
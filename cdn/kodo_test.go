@@ -0,0 +1,223 @@
+package cdn
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1" // #nosec
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeKodo is an upload endpoint storing the uploaded files in memory.
+type fakeKodo struct {
+	mux      sync.Mutex
+	objects  map[string][]byte
+	blocks   map[string][]byte
+	requests []string
+}
+
+func newFakeKodo() *fakeKodo {
+	return &fakeKodo{objects: map[string][]byte{}, blocks: map[string][]byte{}}
+}
+
+// authorize checks the token was signed by the access and secret keys for key.
+func (f *fakeKodo) authorize(token string, key string) error {
+	parts := strings.Split(token, ":")
+	if len(parts) != 3 || parts[0] != "ak" {
+		return fmt.Errorf("bad token")
+	}
+	mac := hmac.New(sha1.New, []byte("sk"))
+	_, _ = mac.Write([]byte(parts[2]))
+	if base64.URLEncoding.EncodeToString(mac.Sum(nil)) != parts[1] {
+		return fmt.Errorf("bad token signature")
+	}
+
+	raw, _ := base64.URLEncoding.DecodeString(parts[2])
+	var policy struct {
+		Scope    string `json:"scope"`
+		Deadline int64  `json:"deadline"`
+	}
+	if err := json.Unmarshal(raw, &policy); err != nil {
+		return err
+	}
+	if policy.Scope != "bucket:"+key || policy.Deadline < time.Now().Unix() {
+		return fmt.Errorf("bad put policy")
+	}
+	return nil
+}
+
+func (f *fakeKodo) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	f.requests = append(f.requests, parts[0])
+	fail := func(code int, message string) {
+		w.WriteHeader(code)
+		_ = json.NewEncoder(w).Encode(map[string]string{"error": message})
+	}
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "UpToken ")
+	chunk := func(ctx string, data []byte) {
+		f.blocks[ctx] = append(f.blocks[ctx], data...)
+		_ = json.NewEncoder(w).Encode(kodoChunk{Ctx: ctx, Crc32: crc32.ChecksumIEEE(data), Offset: int64(len(f.blocks[ctx]))})
+	}
+
+	if parts[0] == "" {
+		f.form(w, r, fail)
+		return
+	}
+
+	body, _ := ioutil.ReadAll(r.Body)
+	switch parts[0] {
+	case "mkblk":
+		chunk(fmt.Sprintf("ctx%d", len(f.blocks)), body)
+	case "bput":
+		if offset, _ := strconv.Atoi(parts[2]); offset != len(f.blocks[parts[1]]) {
+			fail(http.StatusBadRequest, "bad offset")
+			return
+		}
+		chunk(parts[1], body)
+	case "mkfile":
+		raw, _ := base64.URLEncoding.DecodeString(parts[3])
+		key := string(raw)
+		if err := f.authorize(token, key); err != nil {
+			fail(http.StatusUnauthorized, err.Error())
+			return
+		}
+		var data []byte
+		for _, ctx := range strings.Split(string(body), ",") {
+			data = append(data, f.blocks[ctx]...)
+		}
+		if size, _ := strconv.Atoi(parts[1]); size != len(data) {
+			fail(http.StatusBadRequest, "bad size")
+			return
+		}
+		f.objects[key] = data
+		_ = json.NewEncoder(w).Encode(kodoFile{Key: key})
+	default:
+		fail(http.StatusNotFound, "no such api")
+	}
+}
+
+func (f *fakeKodo) form(w http.ResponseWriter, r *http.Request, fail func(int, string)) {
+	_ = r.ParseMultipartForm(1 << 20)
+	key := r.FormValue("key")
+	if err := f.authorize(r.FormValue("token"), key); err != nil {
+		fail(http.StatusUnauthorized, err.Error())
+		return
+	}
+	file, _, err := r.FormFile("file")
+	if err != nil {
+		fail(http.StatusBadRequest, err.Error())
+		return
+	}
+	data, _ := ioutil.ReadAll(file)
+	f.objects[key] = data
+	_ = json.NewEncoder(w).Encode(kodoFile{Key: key})
+}
+
+func TestKodoUploader_uploadToken(t *testing.T) {
+	k := NewKodoUploader("ak", "sk", "bucket")
+	assert.NoError(t, newFakeKodo().authorize(k.uploadToken("a/b.js", time.Now().Add(time.Minute)), "a/b.js"))
+	assert.Error(t, newFakeKodo().authorize(k.uploadToken("a/b.js", time.Now().Add(-time.Minute)), "a/b.js"))
+	assert.Error(t, newFakeKodo().authorize(k.uploadToken("a/b.js", time.Now().Add(time.Minute)), "a/c.js"))
+}
+
+func TestKodoUploader_Upload(t *testing.T) {
+	large := bytes.Repeat([]byte("0123456789"), 20)
+	cases := map[string]struct {
+		secretKey string
+		options   []KodoUploaderOption
+		files     map[string][]byte
+
+		objects  map[string][]byte
+		requests []string
+		failed   int
+	}{
+		"form": {
+			"sk",
+			nil,
+			map[string][]byte{"ab/cd.txt": []byte("small"), "empty": nil, ".DS_Store": []byte("skip")},
+			map[string][]byte{"prefix/ab/cd.txt": []byte("small"), "prefix/empty": {}},
+			[]string{"", ""},
+			0,
+		},
+		"resumable": {
+			"sk",
+			[]KodoUploaderOption{KodoFormLimit(10), KodoChunkSize(40)},
+			map[string][]byte{"large.bin": large},
+			map[string][]byte{"prefix/large.bin": large},
+			// 2 blocks of 100 bytes in 3 chunks each
+			[]string{"mkblk", "bput", "bput", "mkblk", "bput", "bput", "mkfile"},
+			0,
+		},
+		"ignore suffix": {
+			"sk",
+			[]KodoUploaderOption{KodoIgnoreSuffixes(".map")},
+			map[string][]byte{"a.js": []byte("a"), "a.js.map": []byte("map")},
+			map[string][]byte{"prefix/a.js": []byte("a")},
+			[]string{""},
+			0,
+		},
+		"bad keys": {
+			"wrong",
+			[]KodoUploaderOption{KodoFormLimit(10), KodoChunkSize(40)},
+			map[string][]byte{"a.js": []byte("a"), "large.bin": large},
+			map[string][]byte{},
+			[]string{"", "mkblk", "bput", "bput", "mkblk", "bput", "bput", "mkfile"},
+			2,
+		},
+	}
+
+	for name, tc := range cases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "kodo")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+			for name, content := range tc.files {
+				p := filepath.Join(dir, filepath.FromSlash(name))
+				require.NoError(t, os.MkdirAll(filepath.Dir(p), os.ModePerm))
+				require.NoError(t, ioutil.WriteFile(p, content, 0644))
+			}
+
+			fake := newFakeKodo()
+			server := httptest.NewServer(fake)
+			defer server.Close()
+
+			k := NewKodoUploader("ak", tc.secretKey, "bucket", append(tc.options, KodoEndpoint(server.URL+"/"))...)
+			// small blocks keep the test data small
+			k.blockSize = 100
+			errs := k.Upload(dir, "prefix")
+
+			assert.Len(t, errs, tc.failed)
+			for _, err := range errs {
+				require.IsType(t, &UploadError{}, err)
+				require.IsType(t, &KodoError{}, err.(*UploadError).Err)
+				assert.Equal(t, http.StatusUnauthorized, err.(*UploadError).Err.(*KodoError).StatusCode)
+			}
+			assert.Equal(t, tc.objects, fake.objects)
+			assert.Equal(t, tc.requests, fake.requests)
+		})
+	}
+}
+
+func TestKodoUploader_Upload_missingDirectory(t *testing.T) {
+	k := NewKodoUploader("ak", "sk", "bucket", KodoEndpoint("http://127.0.0.1:1"))
+	assert.Len(t, k.Upload("the-directory-must-not-exist", "prefix"), 1)
+}
@@ -0,0 +1,113 @@
+package cdn
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// ManifestEntry records where a staged source file goes on the cdn.
+type ManifestEntry struct {
+	Source      string    `json:"source"`
+	Hash        string    `json:"hash"`
+	Key         string    `json:"key"`
+	Size        int64     `json:"size"`
+	ContentType string    `json:"contentType"`
+	ModTime     time.Time `json:"modTime"`
+}
+
+type manifestFile struct {
+	Files map[string]*ManifestEntry `json:"files"`
+}
+
+// manifestPath is the manifest next to the stage directory.
+func (space *Space) manifestPath() string {
+	return filepath.Clean(space.stageDirectory) + ".manifest.json"
+}
+
+// matches tells whether the source file still is the one staged, from its size and modification time.
+func (entry *ManifestEntry) matches(info os.FileInfo) bool {
+	return entry.Size == info.Size() && entry.ModTime.Equal(info.ModTime())
+}
+
+// Lookup returns the entry of a staged local file, without hashing it again. It is not found when the file
+// changed since it was staged.
+func (space *Space) Lookup(localFile string) (*ManifestEntry, bool) {
+	entry, ok := space.files[filepath.Clean(localFile)]
+	if !ok {
+		return nil, false
+	}
+	info, err := os.Stat(localFile)
+	if err != nil || !entry.matches(info) {
+		return nil, false
+	}
+	return entry, true
+}
+
+func readManifest(path string) (map[string]*ManifestEntry, error) {
+	content, err := ioutil.ReadFile(path) // #nosec
+	if os.IsNotExist(err) {
+		return map[string]*ManifestEntry{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var manifest manifestFile
+	if err := json.Unmarshal(content, &manifest); err != nil {
+		return nil, err
+	}
+	if manifest.Files == nil {
+		manifest.Files = map[string]*ManifestEntry{}
+	}
+	return manifest.Files, nil
+}
+
+// loadManifest reads the manifest saved next to the stage directory, if any.
+func (space *Space) loadManifest() error {
+	files, err := readManifest(space.manifestPath())
+	if err != nil {
+		return err
+	}
+	space.files = files
+	return nil
+}
+
+// SaveManifest writes the manifest next to the stage directory, merged with the entries of the spaces sharing it.
+func (space *Space) SaveManifest() error {
+	path := space.manifestPath()
+	files, err := readManifest(path)
+	if err != nil {
+		files = map[string]*ManifestEntry{}
+	}
+	for source, entry := range space.files {
+		files[source] = entry
+	}
+
+	content, err := json.MarshalIndent(manifestFile{files}, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return err
+	}
+	out, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(out.Name())
+
+	_, err = out.Write(content)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(out.Name(), 0644)
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(out.Name(), path)
+}
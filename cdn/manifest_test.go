@@ -0,0 +1,116 @@
+package cdn
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/BakerHub/trivial/fs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// countingHash counts the files hashed.
+type countingHash struct {
+	Hash
+	count int
+}
+
+func (h *countingHash) FromFile(path string) (string, error) {
+	h.count++
+	return h.Hash.FromFile(path)
+}
+
+func TestSpace_manifest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "manifest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	stage := filepath.Join(dir, "stage")
+	source := filepath.Join(dir, "app.css")
+	writeFiles(t, dir, map[string]string{"app.css": "normal"})
+
+	var u MockUploader
+	u.On("Upload", filepath.Join(stage, "static"), "static").Return(nil)
+	hash := &countingHash{Hash: fs.NewFileHashSHA1()}
+	s := NewSpace(&u, "static", StageDirectory(stage), WithHash(hash))
+	cdnPath, err := s.Stage(source)
+	require.NoError(t, err)
+	assert.Empty(t, s.Push())
+	assert.True(t, fs.Exists(stage+".manifest.json"))
+
+	// a new space finds the staged file without hashing it
+	s = NewSpace(&u, "static", StageDirectory(stage), WithHash(hash))
+	entry, ok := s.Lookup(source)
+	require.True(t, ok)
+	info, err := os.Stat(source)
+	require.NoError(t, err)
+	assert.Equal(t, &ManifestEntry{
+		Source:      source,
+		Hash:        "9c2a6e4809aeef7b7712ca4db05a681452f4f748",
+		Key:         "static/9c/2a6e4809aeef7b7712ca4db05a681452f4f748.css",
+		Size:        6,
+		ContentType: contentTypeByExtension(".css"),
+		ModTime:     info.ModTime().UTC(),
+	}, entry)
+	again, err := s.Stage(source)
+	require.NoError(t, err)
+	assert.Equal(t, cdnPath, again)
+	assert.Equal(t, 1, hash.count)
+
+	// a changed file is hashed and staged again
+	writeFiles(t, dir, map[string]string{"app.css": "changed"})
+	require.NoError(t, os.Chtimes(source, time.Now(), info.ModTime().Add(time.Second)))
+	_, ok = s.Lookup(source)
+	assert.False(t, ok)
+	changed, err := s.Stage(source)
+	require.NoError(t, err)
+	assert.NotEqual(t, cdnPath, changed)
+	assert.Equal(t, 2, hash.count)
+	entry, ok = s.Lookup(source)
+	require.True(t, ok)
+	assert.Equal(t, filepath.ToSlash(changed), entry.Key)
+}
+
+func TestSpace_SaveManifest_merge(t *testing.T) {
+	dir, err := ioutil.TempDir("", "manifest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	stage := filepath.Join(dir, "stage")
+	writeFiles(t, dir, map[string]string{"a.js": "a", "b.png": "b"})
+
+	var u MockUploader
+	a := NewSpace(&u, "js", StageDirectory(stage))
+	b := NewSpace(&u, "img", StageDirectory(stage))
+	_, err = a.Stage(filepath.Join(dir, "a.js"))
+	require.NoError(t, err)
+	_, err = b.Stage(filepath.Join(dir, "b.png"))
+	require.NoError(t, err)
+	require.NoError(t, a.SaveManifest())
+	require.NoError(t, b.SaveManifest())
+
+	s := NewSpace(&u, "any", StageDirectory(stage))
+	_, ok := s.Lookup(filepath.Join(dir, "a.js"))
+	assert.True(t, ok)
+	_, ok = s.Lookup(filepath.Join(dir, "b.png"))
+	assert.True(t, ok)
+
+	cdnPath, err := s.Stage(filepath.Join(dir, "a.js"))
+	require.NoError(t, err)
+	assert.Equal(t, "any/86/f7e437faa5a7fce15d1ddcb9eaeaea377667b8.js", filepath.ToSlash(cdnPath))
+}
+
+func TestNewSpace_invalidManifest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "manifest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	stage := filepath.Join(dir, "stage")
+	writeFiles(t, dir, map[string]string{"stage.manifest.json": "{", "a.js": "a"})
+
+	var u MockUploader
+	s := NewSpace(&u, "js", StageDirectory(stage))
+	_, err = s.Stage(filepath.Join(dir, "a.js"))
+	assert.NoError(t, err)
+	assert.NoError(t, s.SaveManifest(), "an invalid manifest is replaced")
+}
@@ -1,23 +1,54 @@
 package cdn
 
 import (
+	"bufio"
+	"errors"
+	"github.com/BakerHub/trivial/fs"
 	"github.com/BakerHub/trivial/shell"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"strings"
 )
 
 type QShellUploader struct {
-	shell 			 Runner
+	shell        Runner
 	bucket       string
 	skipSuffixes string
-	local		 bool
+	local        bool
 }
 
 type Runner interface {
-	Run(name string, args...string)
+	Run(name string, args ...string) error
 }
 
+// qshellLists are the list files qupload2 writes its results to.
+type qshellLists struct {
+	success   string
+	failure   string
+	overwrite string
+}
+
+// Upload runs qupload2 for directory, it returns an *UploadError per file qshell failed to upload.
 func (qs *QShellUploader) Upload(directory string, prefix string) []error {
-	args := []string {
+	_, errs := qs.UploadWithSummary(directory, prefix)
+	return errs
+}
+
+// UploadWithSummary is Upload also returning the keys uploaded, skipped and failed.
+func (qs *QShellUploader) UploadWithSummary(directory string, prefix string) (*UploadSummary, []error) {
+	listDir, err := ioutil.TempDir("", "qupload2")
+	if err != nil {
+		return &UploadSummary{}, []error{err}
+	}
+	defer os.RemoveAll(listDir)
+
+	lists := qshellLists{
+		success:   filepath.Join(listDir, "success.txt"),
+		failure:   filepath.Join(listDir, "failure.txt"),
+		overwrite: filepath.Join(listDir, "overwrite.txt"),
+	}
+	args := []string{
 		"qupload2",
 		"--src-dir", directory,
 		"--bucket", qs.bucket,
@@ -28,19 +59,110 @@ func (qs *QShellUploader) Upload(directory string, prefix string) []error {
 	if qs.local {
 		args = append(args, "--local")
 	}
+	args = append(args,
+		"--success-list", lists.success,
+		"--failure-list", lists.failure,
+		"--overwrite-list", lists.overwrite,
+	)
+
+	runErr := qs.shell.Run("qshell", args...)
+
+	summary, errs := qs.summarize(directory, prefix, lists, runErr != nil)
+	if runErr != nil && len(errs) == 0 {
+		errs = append(errs, runErr)
+	}
+	return summary, errs
+}
+
+// summarize reads the list files of a qupload2 run, the staged files in none of them were skipped. When the run
+// failed without writing any list, qshell did not get to upload and those files failed instead.
+func (qs *QShellUploader) summarize(directory string, prefix string, lists qshellLists, runFailed bool) (*UploadSummary, []error) {
+	summary := &UploadSummary{}
+	var errs []error
+
+	success, err := readQShellList(lists.success)
+	if err != nil {
+		return summary, []error{err}
+	}
+	failure, err := readQShellList(lists.failure)
+	if err != nil {
+		return summary, []error{err}
+	}
+	overwrite, err := readQShellList(lists.overwrite)
+	if err != nil {
+		return summary, []error{err}
+	}
+
+	done := make(map[string]bool)
+	for _, line := range success {
+		summary.Uploaded = append(summary.Uploaded, line[1])
+		done[line[0]] = true
+	}
+	for _, line := range overwrite {
+		summary.Overwritten = append(summary.Overwritten, line[1])
+	}
+	for _, line := range failure {
+		summary.Failed = append(summary.Failed, line[1])
+		done[line[0]] = true
+		message := "qshell failed to upload the file"
+		if len(line) > 2 && len(line[2]) > 0 {
+			message = line[2]
+		}
+		errs = append(errs, &UploadError{Path: line[0], Key: line[1], Err: errors.New(message)})
+	}
+
+	files, err := stagedFiles(directory, prefix, strings.Split(qs.skipSuffixes, ","))
+	if err != nil {
+		return summary, append(errs, err)
+	}
+	unlisted := &summary.Skipped
+	if runFailed && !fs.Exists(lists.success) && !fs.Exists(lists.failure) && !fs.Exists(lists.overwrite) {
+		unlisted = &summary.Failed
+	}
+	for _, f := range files {
+		abs, err := filepath.Abs(f.path)
+		if err != nil {
+			abs = f.path
+		}
+		if !done[abs] && !done[f.path] {
+			// qshell joins the prefix and the relative path of the file as they are
+			*unlisted = append(*unlisted, prefix+f.rel)
+		}
+	}
+	return summary, errs
+}
 
-	qs.shell.Run("qshell", args...)
+// readQShellList reads the tab separated lines of a list file written by qupload2: the local path, the key
+// and, for failures, the error. A list qshell did not write is empty.
+func readQShellList(path string) ([][]string, error) {
+	file, err := os.Open(path) // #nosec
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
 
-	return nil
+	var lines [][]string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.SplitN(scanner.Text(), "\t", 3)
+		if len(fields) < 2 {
+			continue
+		}
+		lines = append(lines, fields)
+	}
+	return lines, scanner.Err()
 }
 
 type QShellUploaderOption func(*QShellUploader)
 
 func NewQShellUploader(bucket string, opts ...QShellUploaderOption) *QShellUploader {
 	qs := &QShellUploader{
-		shell: &shell.Shell{},
-		bucket: bucket,
-		skipSuffixes: ".DS_Store,Thumbs.db",
+		shell:        &shell.Shell{},
+		bucket:       bucket,
+		skipSuffixes: strings.Join(defaultSkipSuffixes, ","),
 	}
 
 	for _, opt := range opts {
@@ -50,9 +172,9 @@ func NewQShellUploader(bucket string, opts ...QShellUploaderOption) *QShellUploa
 	return qs
 }
 
+// IgnoreSuffixes skips the files ending with one of suffixes, in addition to .DS_Store and Thumbs.db.
 func IgnoreSuffixes(suffixes ...string) QShellUploaderOption {
-	all := append(suffixes, ".DS_Store", "Thumbs.db")
-	ignores := strings.Join(all, ",")
+	ignores := strings.Join(withDefaultSuffixes(suffixes), ",")
 
 	return func(qs *QShellUploader) {
 		qs.skipSuffixes = ignores
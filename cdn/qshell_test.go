@@ -1,8 +1,15 @@
 package cdn
 
 import (
+	"errors"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -42,8 +49,8 @@ type MockShell struct {
 	mock.Mock
 }
 
-func (m *MockShell) Run(name string, runArgs...string) {
-	m.Called(name, runArgs)
+func (m *MockShell) Run(name string, runArgs...string) error {
+	return m.Called(name, runArgs).Error(0)
 }
 
 func WithMockShell(m * MockShell) QShellUploaderOption  {
@@ -102,7 +109,7 @@ func TestQShellUploader_Upload(t *testing.T) {
 			s := MockShell{}
 			options := append(tc.options, WithMockShell(&s))
 			qs := NewQShellUploader(tc.bucket, options...)
-			s.On("Run", tc.want.name, tc.want.args).Return()
+			s.On("Run", tc.want.name, withLists(tc.want.args)).Return(nil)
 
 			qs.Upload(tc.directory, tc.prefix)
 
@@ -110,3 +117,96 @@ func TestQShellUploader_Upload(t *testing.T) {
 		})
 	}
 }
+
+// withLists matches the args of a qupload2 run followed by its list file flags.
+func withLists(args []string) interface{} {
+	return mock.MatchedBy(func(got []string) bool {
+		n := len(args)
+		return len(got) == n+6 && reflect.DeepEqual(args, got[:n]) &&
+			got[n] == "--success-list" && got[n+2] == "--failure-list" && got[n+4] == "--overwrite-list"
+	})
+}
+
+// listFile returns the path given to the flag of a qupload2 run.
+func listFile(args []string, flag string) string {
+	for i, arg := range args[:len(args)-1] {
+		if arg == flag {
+			return args[i+1]
+		}
+	}
+	return ""
+}
+
+func TestQShellUploader_UploadWithSummary(t *testing.T) {
+	dir, err := ioutil.TempDir("", "qshell")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	dir, err = filepath.Abs(dir)
+	require.NoError(t, err)
+	for _, name := range []string{"a.js", "b.css", "c.png", "d/e.txt", ".DS_Store"} {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		require.NoError(t, os.MkdirAll(filepath.Dir(p), os.ModePerm))
+		require.NoError(t, ioutil.WriteFile(p, []byte(name), 0644))
+	}
+
+	lists := map[string]string{
+		"--success-list":   dir + "/a.js\tp/a.js\n" + dir + "/b.css\tp/b.css\n",
+		"--overwrite-list": dir + "/b.css\tp/b.css\n",
+		"--failure-list":   dir + "/c.png\tp/c.png\tincorrect region\n",
+	}
+	cases := map[string]struct {
+		runErr error
+		lists  map[string]string
+
+		summary *UploadSummary
+		errs    []string
+	}{
+		"results": {
+			errors.New("exit status 1"),
+			lists,
+			&UploadSummary{
+				Uploaded:    []string{"p/a.js", "p/b.css"},
+				Overwritten: []string{"p/b.css"},
+				Skipped:     []string{"p/d/e.txt"},
+				Failed:      []string{"p/c.png"},
+			},
+			[]string{"upload " + dir + "/c.png to p/c.png: incorrect region"},
+		},
+		"all skipped": {
+			nil,
+			nil,
+			&UploadSummary{Skipped: []string{"p/a.js", "p/b.css", "p/c.png", "p/d/e.txt"}},
+			nil,
+		},
+		"run failed": {
+			errors.New("qshell: command not found"),
+			nil,
+			&UploadSummary{Failed: []string{"p/a.js", "p/b.css", "p/c.png", "p/d/e.txt"}},
+			[]string{"qshell: command not found"},
+		},
+	}
+
+	for name, tc := range cases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			s := MockShell{}
+			qs := NewQShellUploader("bucket", WithMockShell(&s))
+			s.On("Run", "qshell", mock.Anything).Return(tc.runErr).Run(func(args mock.Arguments) {
+				runArgs := args.Get(1).([]string)
+				for flag, content := range tc.lists {
+					require.NoError(t, ioutil.WriteFile(listFile(runArgs, flag), []byte(content), 0644))
+				}
+			})
+
+			summary, errs := qs.UploadWithSummary(dir, "p/")
+
+			assert.Equal(t, tc.summary, summary)
+			var messages []string
+			for _, err := range errs {
+				messages = append(messages, strings.TrimSpace(err.Error()))
+			}
+			assert.Equal(t, tc.errs, messages)
+			s.AssertExpectations(t)
+		})
+	}
+}
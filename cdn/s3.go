@@ -0,0 +1,366 @@
+package cdn
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	s3Algorithm  = "AWS4-HMAC-SHA256"
+	s3TimeFormat = "20060102T150405Z"
+)
+
+// S3Uploader uploads files to a bucket of S3 or of an S3-compatible storage like MinIO or Ceph RGW, signing
+// its requests with AWS Signature Version 4.
+//
+// Files up to the part size are sent in a single PUT, larger ones in a multipart upload.
+type S3Uploader struct {
+	accessKey    string
+	secretKey    string
+	bucket       string
+	region       string
+	endpoint     string
+	pathStyle    bool
+	client       *http.Client
+	partSize     int64
+	contentType  func(key string) string
+	skipSuffixes []string
+	now          func() time.Time
+}
+
+type S3UploaderOption func(*S3Uploader)
+
+// NewS3Uploader creates an uploader to bucket signing its requests with the access and secret keys.
+func NewS3Uploader(accessKey string, secretKey string, bucket string, opts ...S3UploaderOption) *S3Uploader {
+	s := &S3Uploader{
+		accessKey:    accessKey,
+		secretKey:    secretKey,
+		bucket:       bucket,
+		region:       "us-east-1",
+		client:       http.DefaultClient,
+		partSize:     16 << 20,
+		contentType:  contentTypeByExtension,
+		skipSuffixes: defaultSkipSuffixes,
+		now:          time.Now,
+	}
+
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	if len(s.endpoint) == 0 {
+		s.endpoint = "https://s3." + s.region + ".amazonaws.com"
+	}
+	return s
+}
+
+// S3Region sets the region of the bucket, us-east-1 by default.
+func S3Region(region string) S3UploaderOption {
+	return func(s *S3Uploader) {
+		s.region = region
+	}
+}
+
+// S3Endpoint sets the url of the storage, the AWS endpoint of the region by default.
+func S3Endpoint(endpoint string) S3UploaderOption {
+	return func(s *S3Uploader) {
+		s.endpoint = strings.TrimSuffix(endpoint, "/")
+	}
+}
+
+// S3PathStyle puts the bucket in the path of the urls instead of the host name, as most S3-compatible storages
+// need.
+func S3PathStyle() S3UploaderOption {
+	return func(s *S3Uploader) {
+		s.pathStyle = true
+	}
+}
+
+// S3Client sets the http client sending the requests.
+func S3Client(client *http.Client) S3UploaderOption {
+	return func(s *S3Uploader) {
+		s.client = client
+	}
+}
+
+// S3PartSize sets the size of the parts of the multipart uploads, files up to this size are sent in a single
+// request. S3 needs parts of 5MB at least.
+func S3PartSize(size int64) S3UploaderOption {
+	return func(s *S3Uploader) {
+		if size > 0 {
+			s.partSize = size
+		}
+	}
+}
+
+// S3ContentType sets the Content-Type of the objects from their key, it is guessed from the extension by
+// default.
+func S3ContentType(contentType func(key string) string) S3UploaderOption {
+	return func(s *S3Uploader) {
+		s.contentType = contentType
+	}
+}
+
+// S3IgnoreSuffixes is IgnoreSuffixes for a S3Uploader.
+func S3IgnoreSuffixes(suffixes ...string) S3UploaderOption {
+	all := withDefaultSuffixes(suffixes)
+
+	return func(s *S3Uploader) {
+		s.skipSuffixes = all
+	}
+}
+
+// S3Error is an error response of the storage.
+type S3Error struct {
+	StatusCode int
+	Code       string `xml:"Code"`
+	Message    string `xml:"Message"`
+}
+
+func (e *S3Error) Error() string {
+	return fmt.Sprintf("s3: %d %s: %s", e.StatusCode, e.Code, e.Message)
+}
+
+// Upload uploads the files under directory to keys under prefix, it returns an *UploadError per failed file.
+func (s *S3Uploader) Upload(directory string, prefix string) []error {
+	return uploadFiles(directory, prefix, s.skipSuffixes, s.UploadFile)
+}
+
+// UploadFile uploads localFile to key, replacing the object of the bucket if any.
+func (s *S3Uploader) UploadFile(localFile string, key string) error {
+	file, err := os.Open(localFile) // #nosec
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	if info.Size() <= s.partSize {
+		body, err := ioutil.ReadAll(file)
+		if err != nil {
+			return err
+		}
+		header := http.Header{"Content-Type": {s.contentType(key)}}
+		_, err = s.do(http.MethodPut, key, nil, header, body, nil)
+		return err
+	}
+	return s.multipartUpload(file, key)
+}
+
+type s3Part struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+type s3CompleteMultipartUpload struct {
+	XMLName xml.Name `xml:"CompleteMultipartUpload"`
+	Parts   []s3Part `xml:"Part"`
+}
+
+// multipartUpload sends file in parts of the part size, the upload is aborted when a part fails.
+func (s *S3Uploader) multipartUpload(file io.Reader, key string) error {
+	var initiated struct {
+		UploadID string `xml:"UploadId"`
+	}
+	header := http.Header{"Content-Type": {s.contentType(key)}}
+	if _, err := s.do(http.MethodPost, key, url.Values{"uploads": {""}}, header, nil, &initiated); err != nil {
+		return err
+	}
+
+	err := s.uploadParts(file, key, initiated.UploadID)
+	if err != nil {
+		_, _ = s.do(http.MethodDelete, key, url.Values{"uploadId": {initiated.UploadID}}, nil, nil, nil)
+	}
+	return err
+}
+
+func (s *S3Uploader) uploadParts(file io.Reader, key string, uploadID string) error {
+	var complete s3CompleteMultipartUpload
+	buf := make([]byte, s.partSize)
+	for number := 1; ; number++ {
+		n, err := io.ReadFull(file, buf)
+		if err == io.EOF {
+			break
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return err
+		}
+
+		query := url.Values{"partNumber": {strconv.Itoa(number)}, "uploadId": {uploadID}}
+		resp, err := s.do(http.MethodPut, key, query, nil, buf[:n], nil)
+		if err != nil {
+			return err
+		}
+		complete.Parts = append(complete.Parts, s3Part{PartNumber: number, ETag: resp.Get("ETag")})
+	}
+
+	body, err := xml.Marshal(complete)
+	if err != nil {
+		return err
+	}
+	// the storage may fail the completion after sending a 200 status, with an Error document
+	var completed struct {
+		XMLName xml.Name
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}
+	_, err = s.do(http.MethodPost, key, url.Values{"uploadId": {uploadID}}, nil, body, &completed)
+	if err == nil && completed.XMLName.Local == "Error" {
+		err = &S3Error{StatusCode: http.StatusOK, Code: completed.Code, Message: completed.Message}
+	}
+	return err
+}
+
+// objectURL is the url of key, with the bucket in the host name or in the path.
+func (s *S3Uploader) objectURL(key string, query url.Values) (*url.URL, error) {
+	u, err := url.Parse(s.endpoint)
+	if err != nil {
+		return nil, err
+	}
+	p := "/" + key
+	if s.pathStyle {
+		p = "/" + s.bucket + p
+	} else {
+		u.Host = s.bucket + "." + u.Host
+	}
+	u.Path = u.Path + p
+	u.RawPath = s3Escape(u.Path, false)
+	u.RawQuery = s3Query(query)
+	return u, nil
+}
+
+// do sends a signed request and decodes the XML response to result when not nil, it returns the response
+// header.
+func (s *S3Uploader) do(method string, key string, query url.Values, header http.Header, body []byte, result interface{}) (http.Header, error) {
+	u, err := s.objectURL(key, query)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	s.sign(req, body, s.now())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		e := &S3Error{StatusCode: resp.StatusCode}
+		_ = xml.NewDecoder(resp.Body).Decode(e)
+		if len(e.Code) == 0 {
+			e.Code = http.StatusText(resp.StatusCode)
+		}
+		return nil, e
+	}
+	if result != nil {
+		if err := xml.NewDecoder(resp.Body).Decode(result); err != nil {
+			return nil, err
+		}
+	}
+	return resp.Header, nil
+}
+
+// sign adds the Signature Version 4 authorization of req, signing the host and all the headers of req.
+func (s *S3Uploader) sign(req *http.Request, body []byte, t time.Time) {
+	sum := sha256.Sum256(body)
+	payloadHash := hex.EncodeToString(sum[:])
+	amzDate := t.UTC().Format(s3TimeFormat)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		s3Query(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := amzDate[:8] + "/" + s.region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := s3Algorithm + "\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+s.secretKey), amzDate[:8])
+	for _, part := range []string{s.region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s3Algorithm, s.accessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	_, _ = mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3Query is the canonical query string of SigV4: sorted and escaped, with an = after every name.
+func s3Query(query url.Values) string {
+	var pairs []string
+	for name, values := range query {
+		for _, value := range values {
+			pairs = append(pairs, s3Escape(name, true)+"="+s3Escape(value, true))
+		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "&")
+}
+
+// s3Escape escapes all but the unreserved characters of RFC 3986, and the slashes unless escapeSlash is set.
+func s3Escape(s string, escapeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/' && !escapeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
@@ -3,6 +3,7 @@ package cdn
 import (
 	"fmt"
 	"github.com/BakerHub/trivial/fs"
+	"log"
 	"os"
 	"path/filepath"
 )
@@ -21,7 +22,8 @@ type Space struct {
 	stageDirectory string
 	hash           Hash
 
-	files map[string]string
+	// files is the manifest of the staged files by source path.
+	files map[string]*ManifestEntry
 }
 
 type Option func(space *Space)
@@ -51,6 +53,11 @@ func NewSpace(uploader Uploader, prefix string, options ...Option) *Space {
 		option(space)
 	}
 
+	if err := space.loadManifest(); err != nil {
+		log.Println(err)
+		space.files = map[string]*ManifestEntry{}
+	}
+
 	return space
 }
 
@@ -63,14 +70,6 @@ func (space *Space) makeCdnPath(hash string, extension string) string {
 	return filepath.Join(space.prefix, hash[0:2], filename)
 }
 
-func (space *Space) cdnPath(localFile string) (string, error) {
-	h, err := space.hashFile(localFile)
-	if err != nil {
-		return "", err
-	}
-	return space.makeCdnPath(h, filepath.Ext(localFile)), nil
-}
-
 func (space *Space) copyToStage(localFile, cndPath string) error {
 	stagePath := filepath.Join(space.stageDirectory, cndPath)
 	err := os.MkdirAll(filepath.Dir(stagePath), os.ModePerm)
@@ -81,17 +80,43 @@ func (space *Space) copyToStage(localFile, cndPath string) error {
 }
 
 // Stage put one local file to the stage area and return the final cnd path the file will finally upload to.
+// The file is recorded in the manifest, a file staged before and not changed since is not hashed again.
 func (space *Space) Stage(localFile string) (cdnPath string, err error) {
-	cdnPath, err = space.cdnPath(localFile)
+	info, err := os.Stat(localFile)
+	if err != nil {
+		return "", err
+	}
+	// the entry may come from a space with another prefix sharing the stage directory
+	if entry, ok := space.Lookup(localFile); ok {
+		cdnPath = space.makeCdnPath(entry.Hash, filepath.Ext(localFile))
+		if filepath.ToSlash(cdnPath) == entry.Key && fs.Exists(filepath.Join(space.stageDirectory, cdnPath)) {
+			return cdnPath, nil
+		}
+	}
+
+	h, err := space.hashFile(localFile)
 	if err != nil {
 		return "", err
 	}
+	cdnPath = space.makeCdnPath(h, filepath.Ext(localFile))
 
 	err = space.copyToStage(localFile, cdnPath)
 	if err != nil {
 		return "", err
 	}
 
+	if space.files == nil {
+		space.files = map[string]*ManifestEntry{}
+	}
+	space.files[filepath.Clean(localFile)] = &ManifestEntry{
+		Source:      filepath.Clean(localFile),
+		Hash:        h,
+		Key:         filepath.ToSlash(cdnPath),
+		Size:        info.Size(),
+		ContentType: contentTypeByExtension(localFile),
+		ModTime:     info.ModTime().UTC(),
+	}
+
 	return cdnPath, nil
 }
 
@@ -99,6 +124,10 @@ func (space *Space) stagedRoot() string {
 	return filepath.Join(space.stageDirectory, space.prefix)
 }
 
+// Push saves the manifest and uploads the staged files.
 func (space *Space) Push() []error {
+	if err := space.SaveManifest(); err != nil {
+		return []error{err}
+	}
 	return space.uploader.Upload(space.stagedRoot(), space.prefix)
 }
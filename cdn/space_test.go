@@ -76,7 +76,7 @@ func TestSpace_Stage_success(t *testing.T) {
 			defer tc.stage.MustRemove(t)
 
 			var u MockUploader
-			s := &Space{&u, tc.prefix, tc.stage.Pathname(), tc.hash, map[string]string{}}
+			s := &Space{&u, tc.prefix, tc.stage.Pathname(), tc.hash, map[string]*ManifestEntry{}}
 
 			tc.file.MustCreate(t)
 			defer tc.file.MustRemove(t)
@@ -127,6 +127,7 @@ func TestSpace_Push(t *testing.T) {
 		prefix    = "testprefix"
 		path      = "testdir/testprefix"
 	)
+	defer os.Remove(directory + ".manifest.json")
 	m := &MockUploader{}
 	s := NewSpace(m, prefix, StageDirectory(directory))
 	m.On("Upload", path, prefix).Return(nil)
@@ -0,0 +1,110 @@
+package cdn
+
+import (
+	"fmt"
+	"mime"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// defaultSkipSuffixes are the names of system files never uploaded.
+var defaultSkipSuffixes = []string{".DS_Store", "Thumbs.db"}
+
+// withDefaultSuffixes returns suffixes followed by defaultSkipSuffixes, in a new slice so that the one of the
+// caller is never written to.
+func withDefaultSuffixes(suffixes []string) []string {
+	all := make([]string, 0, len(suffixes)+len(defaultSkipSuffixes))
+	all = append(all, suffixes...)
+	return append(all, defaultSkipSuffixes...)
+}
+
+// UploadError is the failure to upload one file.
+type UploadError struct {
+	Path string
+	Key  string
+	Err  error
+}
+
+func (e *UploadError) Error() string {
+	return fmt.Sprintf("upload %s to %s: %v", e.Path, e.Key, e.Err)
+}
+
+// stagedFile is a file to upload and the key it is uploaded to.
+type stagedFile struct {
+	path string
+	rel  string
+	key  string
+	size int64
+}
+
+// stagedFiles lists the regular files under directory and their keys under prefix, skipping the names ending
+// with one of skipSuffixes.
+func stagedFiles(directory string, prefix string, skipSuffixes []string) ([]stagedFile, error) {
+	var files []stagedFile
+	err := filepath.Walk(directory, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() || hasSuffix(info.Name(), skipSuffixes) {
+			return nil
+		}
+		rel, err := filepath.Rel(directory, p)
+		if err != nil {
+			return err
+		}
+		files = append(files, stagedFile{
+			path: p,
+			rel:  filepath.ToSlash(rel),
+			key:  path.Join(prefix, filepath.ToSlash(rel)),
+			size: info.Size(),
+		})
+		return nil
+	})
+	return files, err
+}
+
+// uploadFiles uploads the staged files under directory one by one with upload, it returns an *UploadError per
+// failed file.
+func uploadFiles(directory string, prefix string, skipSuffixes []string, upload func(localFile string, key string) error) []error {
+	files, err := stagedFiles(directory, prefix, skipSuffixes)
+	if err != nil {
+		return []error{err}
+	}
+
+	var errs []error
+	for _, f := range files {
+		if err := upload(f.path, f.key); err != nil {
+			errs = append(errs, &UploadError{Path: f.path, Key: f.key, Err: err})
+		}
+	}
+	return errs
+}
+
+// contentTypeByExtension is the type of the extension of key, application/octet-stream when unknown.
+func contentTypeByExtension(key string) string {
+	if t := mime.TypeByExtension(path.Ext(key)); len(t) > 0 {
+		return t
+	}
+	return "application/octet-stream"
+}
+
+func hasSuffix(name string, suffixes []string) bool {
+	for _, suffix := range suffixes {
+		if len(suffix) > 0 && strings.HasSuffix(name, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// UploadSummary tells what an upload did with the files of the directory, by key.
+type UploadSummary struct {
+	Uploaded []string
+	// Overwritten lists the uploaded keys that replaced an existing file.
+	Overwritten []string
+	// Skipped lists the keys already up to date.
+	Skipped []string
+	Failed  []string
+}
@@ -0,0 +1,19 @@
+package cdn
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWithDefaultSuffixes(t *testing.T) {
+	suffixes := make([]string, 1, 3)
+	suffixes[0] = ".map"
+
+	all := withDefaultSuffixes(suffixes)
+	other := append(suffixes, ".log")
+
+	assert.Equal(t, []string{".map", ".DS_Store", "Thumbs.db"}, all)
+	assert.Equal(t, []string{".map", ".log"}, other)
+	assert.Equal(t, []string{".DS_Store", "Thumbs.db"}, defaultSkipSuffixes)
+}
@@ -0,0 +1,142 @@
+// Command trivial-fetch downloads the files listed in a manifest through the dn cache.
+//
+//	trivial-fetch [-meta file] [-j n] [-revalidate] manifest.json|manifest.yaml
+//
+// The manifest lists {url, path, sha256} entries, the files are downloaded in parallel and verified against
+// their sha256 when given. A report line is printed per entry and the exit status is 1 when any entry failed.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/BakerHub/trivial/dn"
+	"github.com/BakerHub/trivial/fs"
+)
+
+const (
+	exitOK     = 0
+	exitFailed = 1
+	exitUsage  = 2
+)
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
+}
+
+func run(args []string, stdout io.Writer, stderr io.Writer) int {
+	flags := flag.NewFlagSet("trivial-fetch", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	metaFile := flags.String("meta", ".trivial-fetch.json", "meta `file` of the download cache")
+	jobs := flags.Int("j", 8, "number of parallel downloads")
+	revalidate := flags.Bool("revalidate", false, "check the cached files with the servers")
+	flags.Usage = func() {
+		fmt.Fprintln(stderr, "usage: trivial-fetch [flags] manifest.json|manifest.yaml")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return exitUsage
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return exitUsage
+	}
+
+	manifest := flags.Arg(0)
+	content, err := ioutil.ReadFile(manifest) // #nosec
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitUsage
+	}
+	entries, err := parseManifest(content, isYAML(manifest))
+	if err != nil {
+		fmt.Fprintf(stderr, "%s: %v\n", manifest, err)
+		return exitUsage
+	}
+
+	options := []dn.Option{dn.MaxConcurrent(*jobs)}
+	if *revalidate {
+		options = append(options, dn.Revalidate())
+	}
+	cache, err := dn.OpenCache(*metaFile, options...)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitUsage
+	}
+
+	if fetch(cache, entries, stdout) {
+		return exitOK
+	}
+	return exitFailed
+}
+
+// fetch downloads entries and prints their report, it returns whether all of them succeeded.
+func fetch(cache *dn.Cache, entries []Entry, out io.Writer) bool {
+	handles := make([]*dn.Handle, len(entries))
+	for i, e := range entries {
+		if len(e.SHA256) > 0 {
+			digest := dn.Digest{Algorithm: dn.SHA256, Hex: strings.ToLower(e.SHA256)}
+			handles[i] = cache.FetchVerified(e.URL, e.Path, digest)
+		} else {
+			handles[i] = cache.Fetch(e.URL, e.Path)
+		}
+	}
+
+	var cached, downloaded, failed int
+	var bytes int64
+	for i, h := range handles {
+		result := h.Wait()
+		report, err := place(entries[i], result)
+		if err != nil {
+			failed++
+			fmt.Fprintf(out, "FAIL  %s  %v\n", entries[i].Path, err)
+			continue
+		}
+		if result.Hit {
+			cached++
+		} else {
+			downloaded++
+			bytes += result.Bytes
+		}
+		fmt.Fprintf(out, "ok    %s  %s\n", entries[i].Path, report)
+	}
+
+	ok := true
+	if err := cache.Wait(); err != nil {
+		if waitErr, isWait := err.(*dn.WaitError); !isWait || waitErr.MetaErr != nil {
+			fmt.Fprintf(out, "FAIL  save meta: %v\n", err)
+			ok = false
+		}
+	}
+
+	fmt.Fprintf(out, "%d entries: %d cached, %d downloaded (%d bytes), %d failed\n",
+		len(entries), cached, downloaded, bytes, failed)
+	return ok && failed == 0
+}
+
+// place makes sure the file of e is at e.Path once its fetch returned result, and describes how it got there.
+//
+// The cache answers with the path the url was first saved to, a url cached at another path is copied to e.Path.
+func place(e Entry, result dn.Result) (string, error) {
+	if result.Err != nil {
+		return "", result.Err
+	}
+	if result.Path != e.Path {
+		if err := os.MkdirAll(filepath.Dir(e.Path), os.ModePerm); err != nil {
+			return "", err
+		}
+		if err := fs.CopyFile(result.Path, e.Path); err != nil {
+			return "", err
+		}
+		return "copied from " + result.Path, nil
+	}
+	if result.Hit {
+		return "cached", nil
+	}
+	return fmt.Sprintf("%d bytes", result.Bytes), nil
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/BakerHub/trivial/fs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRun(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = w.Write([]byte("hello"))
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "trivial-fetch")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	manifest := func(name string, content string) string {
+		path := filepath.Join(dir, name)
+		require.NoError(t, ioutil.WriteFile(path, []byte(content), 0644))
+		return path
+	}
+	good := manifest("good.yaml", "- url: "+server.URL+"/a\n  path: "+filepath.Join(dir, "a")+
+		"\n  sha256: "+sum+"\n- url: "+server.URL+"/b\n  path: "+filepath.Join(dir, "b")+"\n")
+	bad := manifest("bad.json", `[{"url": "`+server.URL+`/missing", "path": "`+filepath.Join(dir, "c")+`"},
+		{"url": "`+server.URL+`/d", "path": "`+filepath.Join(dir, "d")+`", "sha256": "`+strings.Repeat("0", 64)+`"}]`)
+	hello := "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"
+	first := manifest("first.json", `[{"url": "data:,hello", "path": "`+filepath.Join(dir, "out", "a.txt")+`", "sha256": "`+hello+`"}]`)
+	second := manifest("second.json", `[{"url": "data:,hello", "path": "`+filepath.Join(dir, "out", "b.txt")+`"}]`)
+	meta := filepath.Join(dir, "meta.json")
+
+	cases := []struct {
+		name string
+		args []string
+
+		setup func()
+
+		code   int
+		report []string
+		files  []string
+	}{
+		{"download", []string{"-meta", meta, good}, nil, exitOK, []string{"ok    " + filepath.Join(dir, "a") + "  5 bytes", "2 downloaded"}, []string{"a", "b"}},
+		{"cached", []string{"-meta", meta, good}, nil, exitOK, []string{"ok    " + filepath.Join(dir, "b") + "  cached", "2 cached"}, []string{"a", "b"}},
+		{"failures", []string{"-meta", meta, "-j", "1", bad}, nil, exitFailed, []string{"FAIL  " + filepath.Join(dir, "c"), "FAIL  " + filepath.Join(dir, "d"), "2 failed"}, nil},
+		{"data url", []string{"-meta", meta, first}, nil, exitOK, []string{"ok    " + filepath.Join(dir, "out", "a.txt") + "  5 bytes"}, []string{"out/a.txt"}},
+		{"cached at another path", []string{"-meta", meta, second}, nil, exitOK, []string{"ok    " + filepath.Join(dir, "out", "b.txt") + "  copied from"}, []string{"out/a.txt", "out/b.txt"}},
+		{"cached file deleted", []string{"-meta", meta, first}, func() {
+			require.NoError(t, os.Remove(filepath.Join(dir, "out", "a.txt")))
+		}, exitOK, []string{"ok    " + filepath.Join(dir, "out", "a.txt") + "  5 bytes", "0 cached, 1 downloaded"}, []string{"out/a.txt"}},
+		{"no manifest", []string{"-meta", meta}, nil, exitUsage, nil, nil},
+		{"missing manifest", []string{"-meta", meta, filepath.Join(dir, "none.json")}, nil, exitUsage, nil, nil},
+		{"invalid manifest", []string{"-meta", meta, manifest("invalid.json", "{")}, nil, exitUsage, nil, nil},
+	}
+
+	// the cases run in order, each one uses the cache left by the previous ones
+	for _, tc := range cases {
+		if tc.setup != nil {
+			tc.setup()
+		}
+		var stdout, stderr bytes.Buffer
+		code := run(tc.args, &stdout, &stderr)
+		assert.Equal(t, tc.code, code, tc.name)
+		for _, line := range tc.report {
+			assert.Contains(t, stdout.String(), line, tc.name)
+		}
+		if tc.code == exitUsage {
+			assert.NotEmpty(t, stderr.String(), tc.name)
+		}
+		for _, name := range tc.files {
+			assert.True(t, fs.Exists(filepath.Join(dir, filepath.FromSlash(name))), "%s: %s", tc.name, name)
+		}
+	}
+	assert.False(t, fs.Exists(filepath.Join(dir, "d")), "a file with the wrong digest is not kept")
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Entry is a file listed in a manifest.
+type Entry struct {
+	URL  string `json:"url"`
+	Path string `json:"path"`
+	// SHA256 is the hex digest the file must match, it is optional.
+	SHA256 string `json:"sha256,omitempty"`
+}
+
+// parseManifest reads a JSON array of entries, or a YAML list of entries when yaml is set.
+func parseManifest(content []byte, yaml bool) ([]Entry, error) {
+	var entries []Entry
+	var err error
+	if yaml {
+		entries, err = parseYAML(content)
+	} else {
+		decoder := json.NewDecoder(bytes.NewReader(content))
+		decoder.DisallowUnknownFields()
+		err = decoder.Decode(&entries)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for i, e := range entries {
+		if len(e.URL) == 0 || len(e.Path) == 0 {
+			return nil, fmt.Errorf("entry %d: url and path are required", i+1)
+		}
+		if len(e.SHA256) > 0 {
+			if sum, err := hex.DecodeString(e.SHA256); err != nil || len(sum) != 32 {
+				return nil, fmt.Errorf("entry %d: invalid sha256 %q", i+1, e.SHA256)
+			}
+		}
+	}
+	return entries, nil
+}
+
+// isYAML tells whether the manifest at path is YAML from its extension.
+func isYAML(path string) bool {
+	ext := strings.ToLower(filepath.Ext(path))
+	return ext == ".yaml" || ext == ".yml"
+}
+
+// parseYAML reads the subset of YAML a manifest needs: a block list of mappings with plain or quoted scalar
+// values, each entry starting with a "- url: ..." line followed by its indented keys.
+func parseYAML(content []byte) ([]Entry, error) {
+	var entries []Entry
+	var current *Entry
+	for n, line := range strings.Split(string(content), "\n") {
+		fail := func(format string, args ...interface{}) ([]Entry, error) {
+			return nil, fmt.Errorf("line %d: %s", n+1, fmt.Sprintf(format, args...))
+		}
+
+		line = strings.TrimRight(line, " \t\r")
+		trimmed := strings.TrimSpace(line)
+		if len(trimmed) == 0 || strings.HasPrefix(trimmed, "#") || trimmed == "---" {
+			continue
+		}
+
+		if trimmed == "-" || strings.HasPrefix(trimmed, "- ") {
+			entries = append(entries, Entry{})
+			current = &entries[len(entries)-1]
+			trimmed = strings.TrimSpace(strings.TrimPrefix(trimmed, "-"))
+			if len(trimmed) == 0 {
+				continue
+			}
+		} else if current == nil || line == trimmed {
+			return fail("want a list of entries")
+		}
+
+		colon := strings.Index(trimmed, ":")
+		if colon < 0 {
+			return fail("want key: value")
+		}
+		value, err := yamlScalar(strings.TrimSpace(trimmed[colon+1:]))
+		if err != nil {
+			return fail("%v", err)
+		}
+		switch key := strings.TrimSpace(trimmed[:colon]); key {
+		case "url":
+			current.URL = value
+		case "path":
+			current.Path = value
+		case "sha256":
+			current.SHA256 = value
+		default:
+			return fail("unknown key %q", key)
+		}
+	}
+	return entries, nil
+}
+
+func yamlScalar(value string) (string, error) {
+	switch {
+	case strings.HasPrefix(value, `"`):
+		return strconv.Unquote(value)
+	case strings.HasPrefix(value, "'"):
+		if len(value) < 2 || !strings.HasSuffix(value, "'") {
+			return "", fmt.Errorf("unterminated string %s", value)
+		}
+		return strings.Replace(value[1:len(value)-1], "''", "'", -1), nil
+	}
+	if i := strings.Index(value, " #"); i >= 0 {
+		value = strings.TrimSpace(value[:i])
+	}
+	return value, nil
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const sum = "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"
+
+func TestParseManifest(t *testing.T) {
+	cases := map[string]struct {
+		content string
+		yaml    bool
+
+		want []Entry
+		ok   bool
+	}{
+		"json": {
+			`[{"url": "https://example.com/a", "path": "a", "sha256": "` + sum + `"}, {"url": "data:,b", "path": "b"}]`,
+			false,
+			[]Entry{{"https://example.com/a", "a", sum}, {"data:,b", "b", ""}},
+			true,
+		},
+		"json unknown field": {`[{"url": "u", "path": "p", "md5": "x"}]`, false, nil, false},
+		"json missing path":  {`[{"url": "u"}]`, false, nil, false},
+		"json bad sha256":    {`[{"url": "u", "path": "p", "sha256": "abc"}]`, false, nil, false},
+		"yaml": {
+			"---\n# files\n- url: https://example.com/a # mirror\n  path: 'it''s/a'\n  sha256: \"" + sum + "\"\n-\n  url: data:,b\n  path: b\n",
+			true,
+			[]Entry{{"https://example.com/a", "it's/a", sum}, {"data:,b", "b", ""}},
+			true,
+		},
+		"yaml empty":       {"# nothing\n", true, nil, true},
+		"yaml not a list":  {"url: u\npath: p\n", true, nil, false},
+		"yaml unknown key": {"- url: u\n  path: p\n  md5: x\n", true, nil, false},
+		"yaml no value":    {"- url\n", true, nil, false},
+		"yaml bad quote":   {"- url: 'u\n  path: p\n", true, nil, false},
+	}
+
+	for name, tc := range cases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			got, err := parseManifest([]byte(tc.content), tc.yaml)
+			if !tc.ok {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.want, got)
+		})
+	}
+}
+
+func TestIsYAML(t *testing.T) {
+	assert.True(t, isYAML("files.yaml"))
+	assert.True(t, isYAML("files.YML"))
+	assert.False(t, isYAML("files.json"))
+}
@@ -0,0 +1,209 @@
+package dn
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/BakerHub/trivial/fs"
+)
+
+// bundleMeta is the name of the meta document in a bundle, it precedes the files.
+const bundleMeta = "meta.json"
+
+// bundleEntry returns the name of the file of url in a bundle.
+func bundleEntry(url string) string {
+	sum := sha256.Sum256([]byte(url))
+	return "files/" + hex.EncodeToString(sum[:])
+}
+
+// Export writes a tar bundle of the cached files and their meta to w, for Import into another cache. Entries
+// whose file is missing are left out. Export should not be called while downloads are running.
+func (cache *Cache) Export(w io.Writer) error {
+	cache.mux.Lock()
+	files := make(map[string]*CacheMeta)
+	for url, meta := range cache.Files {
+		if fs.Exists(meta.Saved) {
+			stored := *meta
+			files[url] = &stored
+		}
+	}
+	cache.mux.Unlock()
+
+	content, err := json.MarshalIndent(&metaDocument{Version: metaVersion, Files: files}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	out := tar.NewWriter(w)
+	err = out.WriteHeader(&tar.Header{
+		Name:    bundleMeta,
+		Mode:    0644,
+		Size:    int64(len(content)),
+		ModTime: time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+	if _, err = out.Write(content); err != nil {
+		return err
+	}
+
+	urls := make([]string, 0, len(files))
+	for url := range files {
+		urls = append(urls, url)
+	}
+	sort.Strings(urls)
+	for _, url := range urls {
+		if err := exportFile(out, bundleEntry(url), files[url].Saved); err != nil {
+			return err
+		}
+	}
+	return out.Close()
+}
+
+func exportFile(out *tar.Writer, name string, path string) error {
+	file, err := os.Open(path) // #nosec
+	if err != nil {
+		return err
+	}
+	defer shouldClose(file)
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	err = out.WriteHeader(&tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    info.Size(),
+		ModTime: info.ModTime(),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, file)
+	return err
+}
+
+// TrustBundles lets Import restore files at absolute paths or paths leaving the working directory, as recorded
+// in bundles exported from caches with such paths. Only bundles from a trusted source should be imported then.
+func TrustBundles() Option {
+	return func(cache *Cache) {
+		cache.trustBundles = true
+	}
+}
+
+// Import adds the files of a bundle written by Export to the cache and saves the meta file. The files are
+// restored at the paths recorded in the bundle, a bundle with a path that is absolute or contains .. fails
+// without writing any file unless the cache trusts bundles. Entries the cache fetched at the same time or later
+// are kept.
+func (cache *Cache) Import(r io.Reader) error {
+	in := tar.NewReader(r)
+	var files map[string]*CacheMeta
+	urls := make(map[string]string)
+	imported := make(map[string]*CacheMeta)
+
+	for {
+		header, err := in.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		if header.Name == bundleMeta {
+			content, err := ioutil.ReadAll(in)
+			if err != nil {
+				return err
+			}
+			if files, err = decodeMeta(content); err != nil {
+				return fmt.Errorf("read bundle meta: %v", err)
+			}
+			for url, meta := range files {
+				if !cache.trustBundles && !isLocalPath(meta.Saved) {
+					return fmt.Errorf("bundle path %s of %s is absolute or leaves the working directory", meta.Saved, url)
+				}
+				urls[bundleEntry(url)] = url
+			}
+			continue
+		}
+		if files == nil {
+			return fmt.Errorf("bundle entry %s precedes the meta", header.Name)
+		}
+
+		url, ok := urls[header.Name]
+		if !ok {
+			return fmt.Errorf("bundle entry %s is not in the meta", header.Name)
+		}
+		meta := files[url]
+		if cache.hasNewer(url, meta) {
+			continue
+		}
+		if err := importFile(in, meta.Saved); err != nil {
+			return err
+		}
+		imported[url] = meta
+	}
+	if files == nil {
+		return errors.New("bundle has no meta")
+	}
+
+	cache.mux.Lock()
+	for url, meta := range imported {
+		cache.Files[url] = meta
+		delete(cache.removed, url)
+	}
+	cache.mux.Unlock()
+	return cache.saveMeta()
+}
+
+// isLocalPath tells whether path is relative and stays below the working directory.
+func isLocalPath(path string) bool {
+	if filepath.IsAbs(path) || filepath.VolumeName(path) != "" || strings.HasPrefix(filepath.ToSlash(path), "/") {
+		return false
+	}
+	for _, part := range strings.Split(filepath.ToSlash(path), "/") {
+		if part == ".." {
+			return false
+		}
+	}
+	return len(path) > 0
+}
+
+// hasNewer tells whether the cache holds a copy of url fetched at the same time as meta or later.
+func (cache *Cache) hasNewer(url string, meta *CacheMeta) bool {
+	cache.mux.Lock()
+	defer cache.mux.Unlock()
+
+	current, ok := cache.Files[url]
+	return ok && !current.FetchedAt.Before(meta.FetchedAt) && fs.Exists(current.Saved)
+}
+
+func importFile(in io.Reader, path string) error {
+	file, err := tempFileFor(path)
+	if err != nil {
+		return err
+	}
+	defer shouldRemove(file.Name())
+
+	_, err = io.Copy(file, in)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return move(file.Name(), path)
+}
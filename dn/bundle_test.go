@@ -0,0 +1,159 @@
+package dn
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCache_Export(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"`+r.URL.Path+`"`)
+		_, _ = w.Write([]byte("content of " + r.URL.Path))
+	}))
+	defer server.Close()
+
+	dir := mustTempDir(t)
+	defer os.RemoveAll(dir)
+
+	metaFile := filepath.Join(dir, "meta.json")
+	cache := NewCache(metaFile)
+	cache.Fetch(server.URL+"/a", filepath.Join(dir, "files", "a.txt"))
+	cache.Fetch(server.URL+"/b", filepath.Join(dir, "files", "b.txt"))
+	require.NoError(t, cache.Wait())
+	cache.Files["http://example.com/gone"] = &CacheMeta{Saved: filepath.Join(dir, "gone")}
+
+	var bundle bytes.Buffer
+	require.NoError(t, cache.Export(&bundle))
+	delete(cache.Files, "http://example.com/gone")
+
+	require.NoError(t, os.RemoveAll(filepath.Join(dir, "files")))
+	require.NoError(t, os.Remove(metaFile))
+
+	offline := NewCache(metaFile, Offline(), TrustBundles())
+	require.NoError(t, offline.Import(&bundle))
+	assert.Equal(t, cache.Files, offline.Files)
+	assert.Equal(t, cache.Files, NewCache(metaFile).Files)
+
+	got := offline.Fetch(server.URL+"/a", filepath.Join(dir, "files", "a.txt")).Wait()
+	assert.NoError(t, got.Err)
+	assert.True(t, got.Hit)
+	assert.Equal(t, "content of /a", mustReadFile(t, got.Path))
+	assert.Equal(t, "content of /b", mustReadFile(t, filepath.Join(dir, "files", "b.txt")))
+	assert.NoError(t, offline.Wait())
+}
+
+func TestCache_Import_newer(t *testing.T) {
+	dir := mustTempDir(t)
+	defer os.RemoveAll(dir)
+
+	old := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	path := filepath.Join(dir, "a.txt")
+
+	exported := NewCache(filepath.Join(dir, "exported.json"))
+	require.NoError(t, ioutil.WriteFile(path, []byte("old"), 0644))
+	exported.Files["http://a"] = &CacheMeta{Saved: path, ETag: "old", FetchedAt: old}
+	var bundle bytes.Buffer
+	require.NoError(t, exported.Export(&bundle))
+
+	require.NoError(t, ioutil.WriteFile(path, []byte("new"), 0644))
+	cache := NewCache(filepath.Join(dir, "meta.json"), TrustBundles())
+	cache.Files["http://a"] = &CacheMeta{Saved: path, ETag: "new", FetchedAt: old.Add(time.Hour)}
+	require.NoError(t, cache.Import(&bundle))
+
+	assert.Equal(t, "new", cache.Files["http://a"].ETag)
+	assert.Equal(t, "new", mustReadFile(t, path))
+}
+
+func TestCache_Import_invalid(t *testing.T) {
+	entry := func(name string, content string) func(*tar.Writer) {
+		return func(out *tar.Writer) {
+			_ = out.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content))})
+			_, _ = out.Write([]byte(content))
+		}
+	}
+
+	cases := map[string][]func(*tar.Writer){
+		"empty":          nil,
+		"file first":     {entry(bundleEntry("http://a"), "a"), entry(bundleMeta, "{}")},
+		"unknown entry":  {entry(bundleMeta, `{"version": 2, "files": {}}`), entry(bundleEntry("http://a"), "a")},
+		"corrupted meta": {entry(bundleMeta, "{")},
+	}
+
+	for name, entries := range cases {
+		entries := entries
+		t.Run(name, func(t *testing.T) {
+			dir := mustTempDir(t)
+			defer os.RemoveAll(dir)
+
+			var bundle bytes.Buffer
+			out := tar.NewWriter(&bundle)
+			for _, write := range entries {
+				write(out)
+			}
+			require.NoError(t, out.Close())
+
+			cache := NewCache(filepath.Join(dir, "meta.json"))
+			assert.Error(t, cache.Import(&bundle))
+			assert.Empty(t, cache.Files)
+		})
+	}
+}
+
+func TestCache_Import_paths(t *testing.T) {
+	cases := map[string]struct {
+		saved   func(dir string) string
+		options []Option
+
+		imported bool
+	}{
+		"absolute":         {func(dir string) string { return filepath.Join(dir, "a.txt") }, nil, false},
+		"parent":           {func(dir string) string { return filepath.Join("..", filepath.Base(dir), "a.txt") }, nil, false},
+		"trusted absolute": {func(dir string) string { return filepath.Join(dir, "a.txt") }, []Option{TrustBundles()}, true},
+	}
+
+	for name, tc := range cases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			dir := mustTempDir(t)
+			defer os.RemoveAll(dir)
+
+			meta, err := json.Marshal(&metaDocument{
+				Version: metaVersion,
+				Files:   map[string]*CacheMeta{"http://a": {Saved: tc.saved(dir)}},
+			})
+			require.NoError(t, err)
+			var bundle bytes.Buffer
+			out := tar.NewWriter(&bundle)
+			for _, entry := range [][2]string{{bundleMeta, string(meta)}, {bundleEntry("http://a"), "a"}} {
+				require.NoError(t, out.WriteHeader(&tar.Header{Name: entry[0], Mode: 0644, Size: int64(len(entry[1]))}))
+				_, err = out.Write([]byte(entry[1]))
+				require.NoError(t, err)
+			}
+			require.NoError(t, out.Close())
+
+			cache := NewCache(filepath.Join(dir, "meta.json"), tc.options...)
+			err = cache.Import(&bundle)
+
+			if tc.imported {
+				assert.NoError(t, err)
+				assert.Equal(t, "a", mustReadFile(t, filepath.Join(dir, "a.txt")))
+			} else {
+				assert.Error(t, err)
+				assert.Empty(t, cache.Files)
+				_, statErr := os.Stat(filepath.Join(dir, "a.txt"))
+				assert.True(t, os.IsNotExist(statErr), "no file is written")
+			}
+		})
+	}
+}
@@ -1,23 +1,43 @@
 package dn
 
 import (
-	"encoding/json"
-	"io"
-	"io/ioutil"
+	"context"
 	"log"
 	"net/http"
 	"os"
-	"path"
 	"sync"
+	"time"
 
-	"github.com/BakerHub/trivial/check"
 	"github.com/BakerHub/trivial/fs"
 )
 
 type CacheMeta struct {
-	Saved string `json:"saved,omitempty"`
-	ETag  string `json:"etag,omitempty"`
-	MD5   string `json:"md5,omitempty"`
+	Saved        string `json:"saved,omitempty"`
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+	MD5          string `json:"md5,omitempty"`
+	Digest       string `json:"digest,omitempty"`
+	Status       int    `json:"status,omitempty"`
+	Retries      int    `json:"retries,omitempty"`
+	// Mirror is the url that served a Resource.
+	Mirror string `json:"mirror,omitempty"`
+	// Mirrors and Race are the ones of the Resource cached under this entry, to download it again.
+	Mirrors []string `json:"mirrors,omitempty"`
+	Race    int      `json:"race,omitempty"`
+	// Extracted is the tree unpacked from the file by the Extract option.
+	Extracted *Extraction `json:"extracted,omitempty"`
+
+	CacheControl string            `json:"cache_control,omitempty"`
+	Expires      string            `json:"expires,omitempty"`
+	Date         string            `json:"date,omitempty"`
+	Vary         string            `json:"vary,omitempty"`
+	VaryHeaders  map[string]string `json:"vary_headers,omitempty"`
+	// Header holds the end-to-end headers of the stored response.
+	Header http.Header `json:"header,omitempty"`
+
+	Size       int64     `json:"size,omitempty"`
+	FetchedAt  time.Time `json:"fetched_at"`
+	AccessedAt time.Time `json:"accessed_at"`
 }
 
 type Cache struct {
@@ -25,90 +45,126 @@ type Cache struct {
 	wg    sync.WaitGroup
 	mux   sync.Mutex
 
-	metaFile string
+	metaFile   string
+	revalidate bool
+	validated  map[string]bool
+	failures   []*DownloadError
+
+	maxConcurrent int
+	maxPerHost    int
+	scheduler     *scheduler
+	retry         RetryPolicy
+	resume        bool
+
+	offline              bool
+	progress             func(Progress)
+	progressInterval     time.Duration
+	stats                Stats
+	extract              bool
+	trustBundles         bool
+	freshness            bool
+	staleWhileRevalidate bool
+	staleIfError         bool
+
+	client          *http.Client
+	transport       http.RoundTripper
+	header          http.Header
+	hostHeaders     map[string]http.Header
+	auth            map[string]Authenticator
+	fetchers        map[string]Fetcher
+	connectTimeout  time.Duration
+	headerTimeout   time.Duration
+	transferTimeout time.Duration
+	inflight        map[*task]context.CancelFunc
+	pending         map[string]*Handle
+	removed         map[string]bool
+	synced          map[string]time.Time
 }
 
-func NewCache(metaFile string) *Cache {
-	c := &Cache{
-		Files:    make(map[string]*CacheMeta),
-		metaFile: metaFile,
-	}
-	c.loadMeta()
-	return c
-}
+type Option func(cache *Cache)
 
-func tempFileFor(pathname string) *os.File {
-	pattern := path.Base(pathname) + "*" + path.Ext(pathname)
-	file, err := ioutil.TempFile("", pattern)
-	check.Check(err)
-	return file
+// now returns the current time the way it reads back from the meta file.
+func now() time.Time {
+	return time.Now().UTC()
 }
 
-func shouldRemove(file string) {
-	if !fs.Exists(file) {
-		return
+// Revalidate makes Fetch send a conditional request for cached files that have an ETag or Last-Modified
+// recorded, the file is only replaced when the server answers with a new version.
+func Revalidate() Option {
+	return func(cache *Cache) {
+		cache.revalidate = true
 	}
+}
 
-	err := os.Remove(file)
-	if err != nil {
-		log.Println(err)
+// Offline makes the cache never touch the network: cached files are used as they are, even when they would
+// be revalidated, and the others fail with CauseOffline.
+func Offline() Option {
+	return func(cache *Cache) {
+		cache.offline = true
 	}
 }
 
-func shouldClose(file io.Closer) {
-	err := file.Close()
-	if err != nil {
-		log.Println(err)
+// MaxConcurrent limits the number of downloads running at the same time, the rest are queued and started in
+// the order they were requested.
+func MaxConcurrent(n int) Option {
+	return func(cache *Cache) {
+		cache.maxConcurrent = n
 	}
 }
 
-func shouldMove(oldLocation, newLocation string) {
-	var err error
-	if fs.Exists(newLocation) {
-		err = os.Remove(newLocation)
-
-	} else {
-		err = os.MkdirAll(path.Dir(newLocation), 0750)
-	}
-	if err != nil {
-		log.Println(err)
+// MaxPerHost limits the number of downloads running at the same time against one host.
+func MaxPerHost(n int) Option {
+	return func(cache *Cache) {
+		cache.maxPerHost = n
 	}
+}
 
-	err = os.Rename(oldLocation, newLocation)
-	if err != nil {
+// NewCache creates a cache recording its downloads in metaFile, a meta file that can not be read is logged
+// and replaced on the next save. Use OpenCache to fail instead.
+func NewCache(metaFile string, options ...Option) *Cache {
+	c := newCache(metaFile, options...)
+	if err := c.loadMeta(); err != nil {
 		log.Println(err)
 	}
+	return c
 }
 
-func downloadFile(url string, savePath string) string {
-	resp, err := http.Get(url) //nolint: gosec
-	if err != nil {
-		log.Println(err)
-		return ""
+func newCache(metaFile string, options ...Option) *Cache {
+	c := &Cache{
+		Files:     make(map[string]*CacheMeta),
+		metaFile:  metaFile,
+		validated: make(map[string]bool),
+		inflight:  make(map[*task]context.CancelFunc),
+		pending:   make(map[string]*Handle),
+		removed:   make(map[string]bool),
+
+		header:      make(http.Header),
+		hostHeaders: make(map[string]http.Header),
+		auth:        make(map[string]Authenticator),
+		fetchers: map[string]Fetcher{
+			"file": FileFetcher(),
+			"data": DataFetcher(),
+		},
 	}
-	defer shouldClose(resp.Body)
-
-	out := tempFileFor(savePath)
-	defer shouldRemove(out.Name())
-
-	// Write the body to file
-	_, err = io.Copy(out, resp.Body)
-	shouldClose(out)
 
-	if err != nil {
-		log.Println(err)
-		return ""
+	for _, option := range options {
+		option(c)
 	}
+	c.scheduler = newScheduler(c.maxConcurrent, c.maxPerHost)
+	c.client = c.newClient()
 
-	fs.EnsureDir(path.Dir(savePath))
-	shouldMove(out.Name(), savePath)
-	return resp.Header.Get("ETag")
+	return c
 }
 
 func (cache *Cache) Check(url string, cachePath string) (bool, string) {
 	cache.mux.Lock()
 	defer cache.mux.Unlock()
+	return cache.checkLocked(url, cachePath)
+}
+
+func (cache *Cache) checkLocked(url string, cachePath string) (bool, string) {
 	if local, ok := cache.Files[url]; ok {
+		local.AccessedAt = now()
 		return true, local.Saved
 	}
 
@@ -118,61 +174,315 @@ func (cache *Cache) Check(url string, cachePath string) (bool, string) {
 	return exists, cachePath
 }
 
-func (cache *Cache) Fetch(url string, cachePath string) string {
-	if ok, localPath := cache.Check(url, cachePath); ok {
-		return localPath
+// Fetch returns the handle of url cached at cachePath, the file is downloaded in the background unless it
+// is already cached. Fetching a url that is still downloading returns the handle of that download.
+func (cache *Cache) Fetch(url string, cachePath string) *Handle {
+	return cache.fetch(&task{ctx: context.Background(), url: url, path: cachePath})
+}
+
+// FetchContext works like Fetch, the download is aborted when ctx is done before it finishes.
+func (cache *Cache) FetchContext(ctx context.Context, url string, cachePath string) *Handle {
+	return cache.fetch(&task{ctx: ctx, url: url, path: cachePath})
+}
+
+// fetch returns the handle of t.url, t is started when the cached copy can not be used.
+func (cache *Cache) fetch(t *task) *Handle {
+	cache.mux.Lock()
+	if h, ok := cache.pending[t.url]; ok {
+		cache.mux.Unlock()
+		return h
+	}
+	ok, localPath := cache.checkLocked(t.url, t.path)
+	h := newHandle(localPath)
+	cache.pending[t.url] = h
+	cache.mux.Unlock()
+
+	// a url still in the meta whose file was deleted is downloaded again
+	ok = ok && fs.Exists(localPath)
+	url, digest := t.url, t.digest
+	t.path, t.handle = localPath, h
+	if cache.offline && ok && (digest == nil || cache.matches(url, localPath, *digest)) {
+		cache.resolve(url, h, cache.hitResult(url, localPath))
+		return h
+	}
+	if ok && digest != nil && !cache.matches(url, localPath, *digest) {
+		// the cached copy is not trusted, so it is not revalidated either
+		cache.start(t)
+		return h
+	}
+	if cache.freshness {
+		return cache.fetchFresh(t, ok)
+	}
+	if ok && !cache.shouldRevalidate(url, localPath) {
+		cache.resolve(url, h, cache.hitResult(url, localPath))
+		return h
+	}
+
+	if cache.revalidate {
+		t.validators = cache.validators(url, localPath)
+	}
+	cache.start(t)
+
+	return h
+}
+
+func (cache *Cache) hitResult(url string, cachePath string) Result {
+	cache.mux.Lock()
+	defer cache.mux.Unlock()
+
+	result := Result{URL: url, Path: cachePath, Hit: true}
+	if meta, ok := cache.Files[url]; ok {
+		result.ETag = meta.ETag
 	}
+	return result
+}
 
-	cache.StartDownload(url, cachePath)
+// resolve completes h, later fetches of url no longer share it. Archives are extracted first with Extract.
+func (cache *Cache) resolve(url string, h *Handle, result Result) {
+	if cache.extract && result.Err == nil {
+		result = cache.extractResult(url, result)
+	}
+	cache.count(result)
+	cache.mux.Lock()
+	if cache.pending[url] == h {
+		delete(cache.pending, url)
+	}
+	cache.mux.Unlock()
 
-	return cachePath
+	h.complete(result)
 }
 
-func (cache *Cache) addMeta(url string, cachePath string, etag string) {
-	if len(etag) == 0 {
-		return
+// shouldRevalidate reports whether a cache hit has to be confirmed with the server, each url is revalidated
+// at most once per Cache.
+func (cache *Cache) shouldRevalidate(url string, cachePath string) bool {
+	if !cache.revalidate {
+		return false
 	}
 
-	meta, exits := cache.Files[url]
+	cache.mux.Lock()
+	defer cache.mux.Unlock()
+	if cache.validated[url] {
+		return false
+	}
+	cache.validated[url] = true
+
+	return cache.validatorsLocked(url, cachePath) != nil
+}
+
+// validatorsLocked returns the stored meta of url when it can be used for a conditional request.
+func (cache *Cache) validatorsLocked(url string, cachePath string) *CacheMeta {
+	meta, ok := cache.Files[url]
+	if !ok || meta.Saved != cachePath || !fs.Exists(cachePath) {
+		return nil
+	}
+	if len(meta.ETag) == 0 && len(meta.LastModified) == 0 {
+		return nil
+	}
+
+	validators := *meta
+	return &validators
+}
+
+func (cache *Cache) validators(url string, cachePath string) *CacheMeta {
+	cache.mux.Lock()
+	defer cache.mux.Unlock()
+	return cache.validatorsLocked(url, cachePath)
+}
+
+// addFailure records err for Wait, the url is forgotten unless a previous copy is still in the cache.
+func (cache *Cache) addFailure(url string, cachePath string, failure *DownloadError) {
+	cache.mux.Lock()
+	defer cache.mux.Unlock()
+
+	cache.failures = append(cache.failures, failure)
+
+	if !fs.Exists(cachePath) {
+		cache.forgetLocked(url)
+	}
+}
+
+func (cache *Cache) addMeta(t *task, result *download) {
+	cache.mux.Lock()
+	defer cache.mux.Unlock()
+	cache.validated[t.url] = true
+	delete(cache.removed, t.url)
+
+	meta, exits := cache.Files[t.url]
 
 	if !exits {
-		meta = &CacheMeta{Saved: cachePath}
-		cache.Files[url] = meta
+		meta = &CacheMeta{Saved: t.path}
+		cache.Files[t.url] = meta
 	}
 
-	hex, err := fs.NewFileHashMD5().FromFile(cachePath)
-	if err != nil {
+	if t.digest != nil {
+		meta.Digest = t.digest.String()
+	} else if !result.notModified {
+		meta.Digest = ""
+	}
+	if !result.notModified || len(meta.MD5) == 0 {
+		hex, err := fs.NewFileHashMD5().FromFile(t.path)
+		if err != nil {
+			return
+		}
+		meta.MD5 = hex
+	}
+	meta.ETag = result.etag
+	meta.LastModified = result.lastModified
+	meta.Status = result.status
+	meta.Retries = result.retries
+	meta.Mirror = result.mirror
+	meta.Mirrors, meta.Race = t.mirrors, t.race
+	meta.Saved = t.path
+
+	meta.storeHeader(result.header, result.notModified)
+	meta.recordHeaders(result.header, result.request, result.notModified)
+	if cache.freshness && noStore(result.header) {
+		cache.forgetLocked(t.url)
 		return
 	}
-	meta.MD5 = hex
-	meta.ETag = etag
-	meta.Saved = cachePath
+
+	meta.FetchedAt = now()
+	meta.AccessedAt = meta.FetchedAt
+	if info, err := os.Stat(t.path); err == nil {
+		meta.Size = info.Size()
+	}
+}
+
+// task is one download queued by the cache.
+type task struct {
+	ctx        context.Context
+	url        string
+	path       string
+	validators *CacheMeta
+	digest     *Digest
+	handle     *Handle
+	// mirrors is not nil for a Resource, url is then its ID.
+	mirrors []string
+	race    int
+}
+
+func (cache *Cache) newTask(url string, cachePath string) *task {
+	t := &task{ctx: context.Background(), url: url, path: cachePath}
+	if cache.revalidate {
+		t.validators = cache.validators(url, cachePath)
+	}
+	return t
 }
 
-func (cache *Cache) StartDownload(url string, cachePath string) {
+// StartDownload downloads url to cachePath in the background, whether it is cached or not.
+func (cache *Cache) StartDownload(url string, cachePath string) *Handle {
+	t := cache.newTask(url, cachePath)
+	cache.start(t)
+	return t.handle
+}
+
+func (cache *Cache) start(t *task) {
+	var cancel context.CancelFunc
+	t.ctx, cancel = context.WithCancel(t.ctx)
+
+	cache.mux.Lock()
+	cache.inflight[t] = cancel
+	if t.handle == nil {
+		t.handle = newHandle(t.path)
+		cache.pending[t.url] = t.handle
+	}
+	cache.mux.Unlock()
+
+	if t.validators != nil {
+		cache.countRevalidation()
+	}
+
 	cache.wg.Add(1)
-	go func(url string, cachePath string) {
+	host := hostOf(t.url)
+	if len(t.mirrors) > 0 {
+		host = hostOf(t.mirrors[0])
+	}
+	cache.scheduler.submit(host, func() {
 		defer cache.wg.Done()
-		etag := downloadFile(url, cachePath)
-		cache.addMeta(url, cachePath, etag)
-	}(url, cachePath)
+		defer cache.finish(t)
+
+		var result *download
+		var err error
+		if t.mirrors != nil {
+			result, err = cache.downloadMirrors(t)
+		} else {
+			result, err = cache.downloadWithRetry(t)
+		}
+		if err != nil {
+			failure := downloadErrorOf(t.url, t.path, err)
+			if cache.usableOnError(t.url, t.path, failure) {
+				stale := cache.hitResult(t.url, t.path)
+				stale.Stale = true
+				stale.Retries = failure.Retries
+				cache.resolve(t.url, t.handle, stale)
+				return
+			}
+
+			cache.addFailure(t.url, t.path, failure)
+			cache.resolve(t.url, t.handle, Result{URL: t.url, Path: t.path, Retries: failure.Retries, Err: failure})
+			return
+		}
+		cache.addMeta(t, result)
+		cache.resolve(t.url, t.handle, Result{
+			URL:     t.url,
+			Path:    t.path,
+			ETag:    result.etag,
+			Bytes:   result.bytes,
+			Hit:     result.notModified,
+			Retries: result.retries,
+		})
+	})
 }
 
-func (cache *Cache) loadMeta() {
-	if !fs.Exists(cache.metaFile) {
-		return
-	}
+func (cache *Cache) finish(t *task) {
+	cache.mux.Lock()
+	defer cache.mux.Unlock()
 
-	file, _ := ioutil.ReadFile(cache.metaFile)
-	_ = json.Unmarshal(file, &cache.Files)
+	cache.inflight[t]()
+	delete(cache.inflight, t)
 }
 
-func (cache *Cache) saveMeta() {
-	file, _ := json.MarshalIndent(cache.Files, "", "  ")
-	_ = ioutil.WriteFile(cache.metaFile, file, 0644)
+// cancelAll aborts every queued and running download.
+func (cache *Cache) cancelAll() {
+	cache.mux.Lock()
+	defer cache.mux.Unlock()
+
+	for _, cancel := range cache.inflight {
+		cancel()
+	}
+}
+
+// Wait blocks until all downloads are finished and saves the meta file. A *WaitError listing every failed
+// download since the last Wait is returned when any of them failed, otherwise the error of saving the meta
+// file is returned.
+func (cache *Cache) Wait() error {
+	return cache.WaitContext(context.Background())
 }
 
-func (cache *Cache) Wait() {
-	cache.wg.Wait()
-	cache.saveMeta()
+// WaitContext works like Wait, but when ctx is done first the downloads still queued or running are
+// canceled and reported as failures with CauseCanceled.
+func (cache *Cache) WaitContext(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		cache.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		cache.cancelAll()
+		<-done
+	}
+	metaErr := cache.saveMeta()
+
+	cache.mux.Lock()
+	defer cache.mux.Unlock()
+	if len(cache.failures) == 0 {
+		return metaErr
+	}
+
+	err := &WaitError{Failures: cache.failures, MetaErr: metaErr}
+	cache.failures = nil
+	return err
 }
@@ -0,0 +1,413 @@
+package dn
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/BakerHub/trivial/fs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func mustTempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "dn-test")
+	require.NoError(t, err)
+	return dir
+}
+
+func mustReadFile(t *testing.T, path string) string {
+	content, err := ioutil.ReadFile(path) // #nosec
+	require.NoError(t, err)
+	return string(content)
+}
+
+func TestCache_Fetch(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		_, _ = w.Write([]byte("content"))
+	}))
+	defer server.Close()
+
+	dir := mustTempDir(t)
+	defer os.RemoveAll(dir)
+
+	metaFile := filepath.Join(dir, "meta.json")
+	cachePath := filepath.Join(dir, "files", "a.txt")
+
+	cache := NewCache(metaFile)
+	got := cache.Fetch(server.URL+"/a.txt", cachePath)
+	assert.NoError(t, cache.Wait())
+
+	assert.Equal(t, cachePath, got.Path())
+	assert.Equal(t, "content", mustReadFile(t, cachePath))
+	assert.Equal(t, `"v1"`, cache.Files[server.URL+"/a.txt"].ETag)
+	assert.Equal(t, "9a0364b9e99bb480dd25e1f0284c8555", cache.Files[server.URL+"/a.txt"].MD5)
+	assert.Equal(t, http.StatusOK, cache.Files[server.URL+"/a.txt"].Status)
+
+	reloaded := NewCache(metaFile)
+	assert.Equal(t, cache.Files, reloaded.Files)
+}
+
+func TestCache_Fetch_deletedFile(t *testing.T) {
+	cases := map[string]struct {
+		options []Option
+	}{
+		"hit":        {nil},
+		"revalidate": {[]Option{Revalidate()}},
+	}
+
+	for name, tc := range cases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			requests := 0
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				requests++
+				w.Header().Set("ETag", `"v1"`)
+				_, _ = w.Write([]byte("content"))
+			}))
+			defer server.Close()
+
+			dir := mustTempDir(t)
+			defer os.RemoveAll(dir)
+
+			metaFile := filepath.Join(dir, "meta.json")
+			cachePath := filepath.Join(dir, "a.txt")
+
+			first := NewCache(metaFile)
+			first.Fetch(server.URL, cachePath)
+			require.NoError(t, first.Wait())
+			require.NoError(t, os.Remove(cachePath))
+
+			second := NewCache(metaFile, tc.options...)
+			got := second.Fetch(server.URL, cachePath).Wait()
+			assert.NoError(t, second.Wait())
+
+			assert.NoError(t, got.Err)
+			assert.False(t, got.Hit)
+			assert.Equal(t, 2, requests)
+			assert.Equal(t, "content", mustReadFile(t, cachePath))
+		})
+	}
+}
+
+func TestCache_Fetch_revalidate(t *testing.T) {
+	const lastModified = "Mon, 02 Jan 2006 15:04:05 GMT"
+
+	cases := map[string]struct {
+		options []Option
+		status  int
+		body    string
+
+		requests        int
+		content         string
+		ifNoneMatch     string
+		ifModifiedSince string
+	}{
+		"not modified": {
+			[]Option{Revalidate()},
+			http.StatusNotModified,
+			"",
+			2,
+			"v1",
+			`"v1"`,
+			lastModified,
+		},
+		"modified": {
+			[]Option{Revalidate()},
+			http.StatusOK,
+			"v2",
+			2,
+			"v2",
+			`"v1"`,
+			lastModified,
+		},
+		"server error keeps cached file": {
+			[]Option{Revalidate()},
+			http.StatusInternalServerError,
+			"error page",
+			2,
+			"v1",
+			`"v1"`,
+			lastModified,
+		},
+		"without revalidate": {
+			nil,
+			http.StatusOK,
+			"v2",
+			1,
+			"v1",
+			"",
+			"",
+		},
+	}
+
+	for name, tc := range cases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			requests := 0
+			var ifNoneMatch, ifModifiedSince string
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				requests++
+				if requests == 1 {
+					w.Header().Set("ETag", `"v1"`)
+					w.Header().Set("Last-Modified", lastModified)
+					_, _ = w.Write([]byte("v1"))
+					return
+				}
+				ifNoneMatch = r.Header.Get("If-None-Match")
+				ifModifiedSince = r.Header.Get("If-Modified-Since")
+				w.WriteHeader(tc.status)
+				_, _ = w.Write([]byte(tc.body))
+			}))
+			defer server.Close()
+
+			dir := mustTempDir(t)
+			defer os.RemoveAll(dir)
+
+			metaFile := filepath.Join(dir, "meta.json")
+			cachePath := filepath.Join(dir, "a.txt")
+
+			first := NewCache(metaFile)
+			first.Fetch(server.URL, cachePath)
+			first.Wait()
+
+			second := NewCache(metaFile, tc.options...)
+			second.Fetch(server.URL, cachePath)
+			second.Fetch(server.URL, cachePath)
+			second.Wait()
+
+			assert.Equal(t, tc.requests, requests)
+			assert.Equal(t, tc.content, mustReadFile(t, cachePath))
+			assert.Equal(t, tc.ifNoneMatch, ifNoneMatch)
+			assert.Equal(t, tc.ifModifiedSince, ifModifiedSince)
+		})
+	}
+}
+
+func TestCache_Wait_failures(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("content"))
+	}))
+	defer server.Close()
+
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+
+	dir := mustTempDir(t)
+	defer os.RemoveAll(dir)
+
+	blocker := filepath.Join(dir, "blocker")
+	require.NoError(t, ioutil.WriteFile(blocker, []byte("not a directory"), 0644))
+
+	cases := map[string]struct {
+		url       string
+		cachePath string
+
+		cause Cause
+	}{
+		"network": {closed.URL, filepath.Join(dir, "network.txt"), CauseNetwork},
+		"disk":    {server.URL, filepath.Join(blocker, "disk.txt"), CauseDisk},
+	}
+
+	for name, tc := range cases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			cache := NewCache(filepath.Join(dir, name+".json"))
+			cache.Fetch(tc.url, tc.cachePath)
+			err := cache.Wait()
+
+			require.IsType(t, &WaitError{}, err)
+			failures := err.(*WaitError).Failures
+			require.Len(t, failures, 1)
+			assert.Equal(t, tc.url, failures[0].URL)
+			assert.Equal(t, tc.cachePath, failures[0].Path)
+			assert.Equal(t, tc.cause, failures[0].Cause)
+			assert.NotContains(t, cache.Files, tc.url)
+
+			assert.NoError(t, cache.Wait(), "failures are reported once")
+		})
+	}
+}
+
+func TestCache_Fetch_status(t *testing.T) {
+	cases := map[string]struct {
+		status   int
+		previous bool
+
+		content string
+	}{
+		"not found":                 {http.StatusNotFound, false, ""},
+		"not found keeps previous":  {http.StatusNotFound, true, "previous"},
+		"server error":              {http.StatusInternalServerError, false, ""},
+		"server error keeps cached": {http.StatusInternalServerError, true, "previous"},
+	}
+
+	for name, tc := range cases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tc.status)
+				_, _ = w.Write([]byte("error page"))
+			}))
+			defer server.Close()
+
+			dir := mustTempDir(t)
+			defer os.RemoveAll(dir)
+
+			cachePath := filepath.Join(dir, "a.txt")
+			if tc.previous {
+				require.NoError(t, ioutil.WriteFile(cachePath, []byte("previous"), 0644))
+			}
+
+			cache := NewCache(filepath.Join(dir, "meta.json"))
+			cache.StartDownload(server.URL, cachePath)
+			err := cache.Wait()
+
+			require.IsType(t, &WaitError{}, err)
+			failure := err.(*WaitError).Failures[0]
+			assert.Equal(t, CauseStatus, failure.Cause)
+			assert.Equal(t, tc.status, failure.StatusCode())
+
+			if tc.previous {
+				assert.Equal(t, tc.content, mustReadFile(t, cachePath))
+			} else {
+				assert.False(t, fs.Exists(cachePath))
+			}
+		})
+	}
+}
+
+func stalledServer() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "100")
+		_, _ = w.Write([]byte("partial"))
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+}
+
+func TestCache_WaitContext(t *testing.T) {
+	server := stalledServer()
+	defer server.Close()
+
+	dir := mustTempDir(t)
+	defer os.RemoveAll(dir)
+
+	tmp := filepath.Join(dir, "tmp")
+	require.NoError(t, os.Mkdir(tmp, 0750))
+	defer os.Setenv("TMPDIR", os.Getenv("TMPDIR"))
+	require.NoError(t, os.Setenv("TMPDIR", tmp))
+
+	metaFile := filepath.Join(dir, "meta.json")
+	cachePath := filepath.Join(dir, "a.txt")
+
+	cache := NewCache(metaFile, MaxConcurrent(1))
+	cache.Fetch(server.URL+"/a", cachePath)
+	cache.Fetch(server.URL+"/queued", filepath.Join(dir, "queued.txt"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err := cache.WaitContext(ctx)
+
+	require.IsType(t, &WaitError{}, err)
+	failures := err.(*WaitError).Failures
+	require.Len(t, failures, 2)
+	for _, failure := range failures {
+		assert.Equal(t, CauseCanceled, failure.Cause)
+		assert.Equal(t, context.Canceled, failure.Err)
+	}
+
+	assert.False(t, fs.Exists(cachePath))
+	assert.Empty(t, NewCache(metaFile).Files)
+	leftovers, err := ioutil.ReadDir(tmp)
+	require.NoError(t, err)
+	assert.Empty(t, leftovers)
+}
+
+func TestCache_FetchContext(t *testing.T) {
+	server := stalledServer()
+	defer server.Close()
+
+	dir := mustTempDir(t)
+	defer os.RemoveAll(dir)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	cache := NewCache(filepath.Join(dir, "meta.json"))
+	cache.FetchContext(ctx, server.URL, filepath.Join(dir, "a.txt"))
+	err := cache.Wait()
+
+	require.IsType(t, &WaitError{}, err)
+	failure := err.(*WaitError).Failures[0]
+	assert.Equal(t, CauseCanceled, failure.Cause)
+	assert.Equal(t, context.DeadlineExceeded, failure.Err)
+}
+
+func TestCache_Fetch_offline(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.Header().Set("ETag", `"v1"`)
+		_, _ = w.Write([]byte("content"))
+	}))
+	defer server.Close()
+
+	dir := mustTempDir(t)
+	defer os.RemoveAll(dir)
+
+	metaFile := filepath.Join(dir, "meta.json")
+	cachePath := filepath.Join(dir, "a.txt")
+	cache := NewCache(metaFile)
+	cache.Fetch(server.URL+"/a", cachePath)
+	require.NoError(t, cache.Wait())
+
+	cache = NewCache(metaFile, Offline(), Revalidate())
+	hit := cache.Fetch(server.URL+"/a", cachePath).Wait()
+	miss := cache.Fetch(server.URL+"/b", filepath.Join(dir, "b.txt")).Wait()
+	err := cache.Wait()
+
+	assert.True(t, hit.Hit)
+	assert.NoError(t, hit.Err)
+	require.IsType(t, &DownloadError{}, miss.Err)
+	assert.Equal(t, CauseOffline, miss.Err.(*DownloadError).Cause)
+	assert.Equal(t, ErrNotCached, miss.Err.(*DownloadError).Err)
+	require.IsType(t, &WaitError{}, err)
+	assert.Len(t, err.(*WaitError).Failures, 1)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&requests))
+	assert.NotContains(t, cache.Files, server.URL+"/b")
+}
+
+func TestCache_Fetch_tempFilesNextToCachePath(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("content"))
+	}))
+	defer server.Close()
+
+	dir := mustTempDir(t)
+	defer os.RemoveAll(dir)
+	// downloads do not go through the temporary directory, it may be on another file system
+	tmpdir := os.Getenv("TMPDIR")
+	require.NoError(t, os.Setenv("TMPDIR", filepath.Join(dir, "missing")))
+	defer os.Setenv("TMPDIR", tmpdir)
+
+	cache := NewCache(filepath.Join(dir, "meta.json"))
+	httpPath := filepath.Join(dir, "sub", "http")
+	dataPath := filepath.Join(dir, "sub", "data")
+	assert.NoError(t, cache.Fetch(server.URL, httpPath).Wait().Err)
+	assert.NoError(t, cache.Fetch("data:,content", dataPath).Wait().Err)
+	require.NoError(t, cache.Wait())
+
+	assert.Equal(t, "content", mustReadFile(t, httpPath))
+	assert.Equal(t, "content", mustReadFile(t, dataPath))
+	entries, err := ioutil.ReadDir(filepath.Join(dir, "sub"))
+	require.NoError(t, err)
+	assert.Len(t, entries, 2, "no temporary file is left")
+}
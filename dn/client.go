@@ -0,0 +1,174 @@
+package dn
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// ConnectTimeout limits the time spent on establishing a connection, including the TLS handshake.
+func ConnectTimeout(d time.Duration) Option {
+	return func(cache *Cache) {
+		cache.connectTimeout = d
+	}
+}
+
+// HeaderTimeout limits the time spent waiting for the response headers once the request is sent.
+func HeaderTimeout(d time.Duration) Option {
+	return func(cache *Cache) {
+		cache.headerTimeout = d
+	}
+}
+
+// TransferTimeout limits the total time of one download attempt, from sending the request to reading the
+// last byte of the body.
+func TransferTimeout(d time.Duration) Option {
+	return func(cache *Cache) {
+		cache.transferTimeout = d
+	}
+}
+
+// WithClient makes the cache send its requests with client, ConnectTimeout and HeaderTimeout are ignored as
+// they are part of the client configuration.
+func WithClient(client *http.Client) Option {
+	return func(cache *Cache) {
+		cache.client = client
+	}
+}
+
+// WithTransport makes the cache send its requests through rt, ConnectTimeout and HeaderTimeout are ignored
+// as they are part of the transport configuration.
+func WithTransport(rt http.RoundTripper) Option {
+	return func(cache *Cache) {
+		cache.transport = rt
+	}
+}
+
+// Header adds a header to every request.
+func Header(key string, value string) Option {
+	return func(cache *Cache) {
+		cache.header.Add(key, value)
+	}
+}
+
+// UserAgent sets the User-Agent header of every request.
+func UserAgent(userAgent string) Option {
+	return func(cache *Cache) {
+		cache.header.Set("User-Agent", userAgent)
+	}
+}
+
+// HostHeader adds a header to the requests sent to host, host is either a host name or host:port.
+func HostHeader(host string, key string, value string) Option {
+	return func(cache *Cache) {
+		header, ok := cache.hostHeaders[host]
+		if !ok {
+			header = make(http.Header)
+			cache.hostHeaders[host] = header
+		}
+		header.Add(key, value)
+	}
+}
+
+// Authenticator adds credentials to a request before it is sent.
+type Authenticator interface {
+	Authenticate(req *http.Request) error
+}
+
+// AuthenticatorFunc adapts a function to an Authenticator.
+type AuthenticatorFunc func(req *http.Request) error
+
+func (f AuthenticatorFunc) Authenticate(req *http.Request) error {
+	return f(req)
+}
+
+// BasicAuth authenticates requests with a user name and password.
+func BasicAuth(username string, password string) Authenticator {
+	return AuthenticatorFunc(func(req *http.Request) error {
+		req.SetBasicAuth(username, password)
+		return nil
+	})
+}
+
+// BearerToken authenticates requests with an OAuth 2.0 bearer token.
+func BearerToken(token string) Authenticator {
+	return AuthenticatorFunc(func(req *http.Request) error {
+		req.Header.Set("Authorization", "Bearer "+token)
+		return nil
+	})
+}
+
+// Auth authenticates the requests sent to host with auth, an empty host applies to every host without its
+// own authenticator. Host is either a host name or host:port.
+func Auth(host string, auth Authenticator) Option {
+	return func(cache *Cache) {
+		cache.auth[host] = auth
+	}
+}
+
+// hostKeys returns the keys the options may have registered for the host of u, host:port comes first.
+func hostKeys(u *url.URL) []string {
+	if len(u.Port()) == 0 {
+		return []string{u.Host}
+	}
+	return []string{u.Host, u.Hostname()}
+}
+
+// prepare adds the configured headers and credentials to req.
+func (cache *Cache) prepare(req *http.Request) error {
+	for key, values := range cache.header {
+		req.Header[key] = append([]string(nil), values...)
+	}
+
+	hosts := hostKeys(req.URL)
+	for _, host := range hosts {
+		if header, ok := cache.hostHeaders[host]; ok {
+			for key, values := range header {
+				req.Header[key] = append([]string(nil), values...)
+			}
+			break
+		}
+	}
+
+	for _, host := range append(hosts, "") {
+		if auth, ok := cache.auth[host]; ok {
+			return auth.Authenticate(req)
+		}
+	}
+	return nil
+}
+
+// newClient returns the http client used by the cache, http.DefaultClient unless a transport or a timeout
+// is configured.
+func (cache *Cache) newClient() *http.Client {
+	if cache.client != nil {
+		return cache.client
+	}
+	if cache.transport != nil {
+		return &http.Client{Transport: cache.transport}
+	}
+	if cache.connectTimeout <= 0 && cache.headerTimeout <= 0 {
+		return http.DefaultClient
+	}
+
+	handshakeTimeout := 10 * time.Second
+	if cache.connectTimeout > 0 {
+		handshakeTimeout = cache.connectTimeout
+	}
+	dialer := &net.Dialer{
+		Timeout:   cache.connectTimeout,
+		KeepAlive: 30 * time.Second,
+	}
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy:                 http.ProxyFromEnvironment,
+			DialContext:           dialer.DialContext,
+			TLSHandshakeTimeout:   handshakeTimeout,
+			ResponseHeaderTimeout: cache.headerTimeout,
+			MaxIdleConns:          100,
+			IdleConnTimeout:       90 * time.Second,
+			ExpectContinueTimeout: time.Second,
+		},
+	}
+}
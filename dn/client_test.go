@@ -0,0 +1,167 @@
+package dn
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCache_timeouts(t *testing.T) {
+	slowHeaders := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(time.Second):
+		}
+	}))
+	defer slowHeaders.Close()
+
+	slowBody := stalledServer()
+	defer slowBody.Close()
+
+	cases := map[string]struct {
+		url    string
+		option Option
+	}{
+		"header":   {slowHeaders.URL, HeaderTimeout(50 * time.Millisecond)},
+		"transfer": {slowBody.URL, TransferTimeout(50 * time.Millisecond)},
+	}
+
+	for name, tc := range cases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			dir := mustTempDir(t)
+			defer os.RemoveAll(dir)
+
+			start := time.Now()
+			cache := NewCache(filepath.Join(dir, "meta.json"), tc.option)
+			cache.Fetch(tc.url, filepath.Join(dir, "a.txt"))
+			err := cache.Wait()
+
+			assert.True(t, time.Since(start) < 900*time.Millisecond, "timeout not applied")
+			require.IsType(t, &WaitError{}, err)
+			failure := err.(*WaitError).Failures[0]
+			assert.Equal(t, CauseNetwork, failure.Cause)
+			assert.True(t, IsRetryable(failure))
+		})
+	}
+}
+
+func TestCache_newClient(t *testing.T) {
+	assert.Equal(t, http.DefaultClient, NewCache("").client)
+
+	client := NewCache("", ConnectTimeout(time.Second)).client
+	assert.NotEqual(t, http.DefaultClient, client)
+	assert.Equal(t, time.Second, client.Transport.(*http.Transport).TLSHandshakeTimeout)
+}
+
+type recordingTransport struct {
+	requests []*http.Request
+}
+
+func (rt *recordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	rt.requests = append(rt.requests, req)
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Status:     "200 OK",
+		Header:     make(http.Header),
+		Body:       ioutil.NopCloser(strings.NewReader("from transport")),
+		Request:    req,
+	}, nil
+}
+
+func TestCache_prepare(t *testing.T) {
+	cases := map[string]struct {
+		url     string
+		options []Option
+
+		header http.Header
+	}{
+		"no options": {
+			"http://example.com/a",
+			nil,
+			http.Header{},
+		},
+		"user agent and header": {
+			"http://example.com/a",
+			[]Option{UserAgent("trivial/1.0"), Header("X-Trace", "1")},
+			http.Header{"User-Agent": {"trivial/1.0"}, "X-Trace": {"1"}},
+		},
+		"host header": {
+			"http://example.com:8080/a",
+			[]Option{HostHeader("example.com", "X-Key", "a"), HostHeader("other.com", "X-Key", "b")},
+			http.Header{"X-Key": {"a"}},
+		},
+		"host:port wins": {
+			"http://example.com:8080/a",
+			[]Option{HostHeader("example.com", "X-Key", "a"), HostHeader("example.com:8080", "X-Key", "b")},
+			http.Header{"X-Key": {"b"}},
+		},
+		"bearer token": {
+			"http://example.com/a",
+			[]Option{Auth("example.com", BearerToken("token")), Auth("", BasicAuth("u", "p"))},
+			http.Header{"Authorization": {"Bearer token"}},
+		},
+		"fallback auth": {
+			"http://other.com/a",
+			[]Option{Auth("example.com", BearerToken("token")), Auth("", BasicAuth("u", "p"))},
+			http.Header{"Authorization": {"Basic dTpw"}},
+		},
+	}
+
+	for name, tc := range cases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, tc.url, nil)
+			require.NoError(t, err)
+
+			cache := NewCache("", tc.options...)
+			require.NoError(t, cache.prepare(req))
+			assert.Equal(t, tc.header, req.Header)
+		})
+	}
+}
+
+func TestCache_prepare_authError(t *testing.T) {
+	dir := mustTempDir(t)
+	defer os.RemoveAll(dir)
+
+	auth := AuthenticatorFunc(func(req *http.Request) error {
+		return errors.New("token expired")
+	})
+	cache := NewCache(filepath.Join(dir, "meta.json"), Auth("", auth))
+	cache.Fetch("http://example.com/a", filepath.Join(dir, "a.txt"))
+	err := cache.Wait()
+
+	require.IsType(t, &WaitError{}, err)
+	failure := err.(*WaitError).Failures[0]
+	assert.Equal(t, CauseRequest, failure.Cause)
+	assert.False(t, IsRetryable(failure))
+}
+
+func TestWithTransport(t *testing.T) {
+	dir := mustTempDir(t)
+	defer os.RemoveAll(dir)
+
+	rt := &recordingTransport{}
+	cache := NewCache(filepath.Join(dir, "meta.json"), WithTransport(rt), UserAgent("trivial"))
+	cache.Fetch("http://artifacts.invalid/a", filepath.Join(dir, "a.txt"))
+	require.NoError(t, cache.Wait())
+
+	require.Len(t, rt.requests, 1)
+	assert.Equal(t, "trivial", rt.requests[0].Header.Get("User-Agent"))
+	assert.Equal(t, "from transport", mustReadFile(t, filepath.Join(dir, "a.txt")))
+}
+
+func TestWithClient(t *testing.T) {
+	client := &http.Client{}
+	assert.Equal(t, client, NewCache("", WithClient(client), ConnectTimeout(time.Second)).client)
+}
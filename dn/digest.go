@@ -0,0 +1,164 @@
+package dn
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/BakerHub/trivial/fs"
+)
+
+// Algorithms accepted in a Digest.
+const (
+	SHA256 = "sha256"
+	SHA1   = "sha1"
+	MD5    = "md5"
+)
+
+// Digest is the expected checksum of a file.
+type Digest struct {
+	Algorithm string
+	Hex       string
+}
+
+// ParseDigest parses a digest written as "<algorithm>:<hex>", for example "sha256:e3b0c442...".
+func ParseDigest(value string) (Digest, error) {
+	parts := strings.SplitN(value, ":", 2)
+	if len(parts) != 2 || len(parts[1]) == 0 {
+		return Digest{}, fmt.Errorf("invalid digest %q, want <algorithm>:<hex>", value)
+	}
+
+	d := Digest{Algorithm: strings.ToLower(parts[0]), Hex: strings.ToLower(parts[1])}
+	if _, err := d.hash(); err != nil {
+		return Digest{}, err
+	}
+	return d, nil
+}
+
+func (d Digest) String() string {
+	return d.Algorithm + ":" + d.Hex
+}
+
+func (d Digest) hash() (*fs.FileHash, error) {
+	switch d.Algorithm {
+	case SHA256:
+		return fs.NewFileHashSHA256(), nil
+	case SHA1:
+		return fs.NewFileHashSHA1(), nil
+	case MD5:
+		return fs.NewFileHashMD5(), nil
+	default:
+		return nil, fmt.Errorf("unsupported digest algorithm %q", d.Algorithm)
+	}
+}
+
+// Check hashes the file at path, a *ChecksumError is returned when it does not match.
+func (d Digest) Check(path string) error {
+	h, err := d.hash()
+	if err != nil {
+		return err
+	}
+
+	actual, err := h.FromFile(path)
+	if err != nil {
+		return err
+	}
+	if !strings.EqualFold(actual, d.Hex) {
+		return &ChecksumError{Expected: d, Actual: actual}
+	}
+	return nil
+}
+
+// storedDigest returns the digest a cache entry is verified against: the expected digest given to
+// FetchVerified, or the MD5 recorded after the download.
+func (meta *CacheMeta) storedDigest() (Digest, bool) {
+	if len(meta.Digest) > 0 {
+		if d, err := ParseDigest(meta.Digest); err == nil {
+			return d, true
+		}
+	}
+	if len(meta.MD5) > 0 {
+		return Digest{Algorithm: MD5, Hex: meta.MD5}, true
+	}
+	return Digest{}, false
+}
+
+// FetchVerified works like Fetch but only accepts a file matching digest. A cached copy that does not match
+// is downloaded again, and a download that does not match is rejected and reported by Wait.
+func (cache *Cache) FetchVerified(url string, cachePath string, digest Digest) *Handle {
+	return cache.fetch(&task{ctx: context.Background(), url: url, path: cachePath, digest: &digest})
+}
+
+// matches reports whether the cached file of url matches digest, a matching digest is recorded in the meta.
+func (cache *Cache) matches(url string, cachePath string, digest Digest) bool {
+	cache.mux.Lock()
+	meta, ok := cache.Files[url]
+	stored := ok && meta.Digest == digest.String()
+	cache.mux.Unlock()
+
+	if stored && fs.Exists(cachePath) {
+		return true
+	}
+	if digest.Check(cachePath) != nil {
+		return false
+	}
+
+	cache.mux.Lock()
+	defer cache.mux.Unlock()
+	if meta, ok := cache.Files[url]; ok {
+		meta.Digest = digest.String()
+	}
+	return true
+}
+
+// VerifyAction tells Verify what to do with a corrupted cache entry.
+type VerifyAction int
+
+const (
+	// Evict removes the corrupted file together with its meta entry.
+	Evict VerifyAction = iota
+	// Redownload removes the corrupted file and downloads it again, failures are reported by Wait.
+	Redownload
+)
+
+// Verify re-hashes every file in Files against its stored digest and returns the urls of the entries
+// that are missing or do not match, entries without any digest are skipped.
+func (cache *Cache) Verify(action VerifyAction) []string {
+	cache.mux.Lock()
+	entries := make(map[string]CacheMeta, len(cache.Files))
+	for url, meta := range cache.Files {
+		entries[url] = *meta
+	}
+	cache.mux.Unlock()
+
+	urls := make([]string, 0, len(entries))
+	for url := range entries {
+		urls = append(urls, url)
+	}
+	sort.Strings(urls)
+
+	var corrupted []string
+	for _, url := range urls {
+		meta := entries[url]
+		digest, ok := meta.storedDigest()
+		if !ok || digest.Check(meta.Saved) == nil {
+			continue
+		}
+		corrupted = append(corrupted, url)
+
+		shouldRemove(meta.Saved)
+		cache.mux.Lock()
+		cache.forgetLocked(url)
+		cache.mux.Unlock()
+
+		if action == Redownload {
+			t := &task{ctx: context.Background(), url: url, path: meta.Saved, mirrors: meta.Mirrors, race: meta.Race}
+			if len(meta.Digest) > 0 {
+				t.digest = &digest
+			}
+			cache.start(t)
+		}
+	}
+	return corrupted
+}
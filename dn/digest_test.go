@@ -0,0 +1,188 @@
+package dn
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/BakerHub/trivial/fs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	contentSHA256 = "ed7002b439e9ac845f22357d822bac1444730fbdb6016d3ec9432297b9ec9f73"
+	contentSHA1   = "040f06fd774092478d450774f5ba30c5da78acc8"
+	contentMD5    = "9a0364b9e99bb480dd25e1f0284c8555"
+)
+
+func TestParseDigest(t *testing.T) {
+	cases := map[string]struct {
+		value string
+
+		want Digest
+		ok   bool
+	}{
+		"sha256":      {"sha256:" + contentSHA256, Digest{SHA256, contentSHA256}, true},
+		"upper case":  {"SHA1:" + "040F06FD774092478D450774F5BA30C5DA78ACC8", Digest{SHA1, contentSHA1}, true},
+		"md5":         {"md5:" + contentMD5, Digest{MD5, contentMD5}, true},
+		"no hex":      {"sha256:", Digest{}, false},
+		"no colon":    {contentSHA256, Digest{}, false},
+		"unsupported": {"crc32:abcd", Digest{}, false},
+	}
+
+	for name, tc := range cases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			got, err := ParseDigest(tc.value)
+			if !tc.ok {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.want, got)
+		})
+	}
+}
+
+func TestDigest_Check(t *testing.T) {
+	file := fs.NewMockFile("digest-check.txt", "content")
+	file.MustCreate(t)
+	defer file.MustRemove(t)
+
+	assert.NoError(t, Digest{SHA256, contentSHA256}.Check(file.Pathname()))
+	assert.NoError(t, Digest{SHA1, contentSHA1}.Check(file.Pathname()))
+	assert.NoError(t, Digest{MD5, contentMD5}.Check(file.Pathname()))
+
+	err := Digest{SHA256, "00"}.Check(file.Pathname())
+	require.IsType(t, &ChecksumError{}, err)
+	assert.Equal(t, contentSHA256, err.(*ChecksumError).Actual)
+}
+
+func TestCache_FetchVerified(t *testing.T) {
+	cases := map[string]struct {
+		digest   Digest
+		previous string
+
+		content  string
+		requests int32
+		cause    Cause
+	}{
+		"match": {
+			Digest{SHA256, contentSHA256}, "",
+			"content", 1, "",
+		},
+		"mismatch": {
+			Digest{SHA256, "00"}, "",
+			"", 1, CauseChecksum,
+		},
+		"mismatch keeps previous": {
+			Digest{SHA1, "00"}, "previous",
+			"previous", 1, CauseChecksum,
+		},
+		"cached copy matches": {
+			Digest{MD5, contentMD5}, "content",
+			"content", 0, "",
+		},
+		"cached copy corrupted": {
+			Digest{SHA256, contentSHA256}, "corrupted",
+			"content", 1, "",
+		},
+	}
+
+	for name, tc := range cases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			var requests int32
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				atomic.AddInt32(&requests, 1)
+				_, _ = w.Write([]byte("content"))
+			}))
+			defer server.Close()
+
+			dir := mustTempDir(t)
+			defer os.RemoveAll(dir)
+
+			cachePath := filepath.Join(dir, "a.txt")
+			if len(tc.previous) > 0 {
+				require.NoError(t, ioutil.WriteFile(cachePath, []byte(tc.previous), 0644))
+			}
+
+			cache := NewCache(filepath.Join(dir, "meta.json"))
+			cache.FetchVerified(server.URL, cachePath, tc.digest)
+			err := cache.Wait()
+
+			assert.Equal(t, tc.requests, atomic.LoadInt32(&requests))
+			if len(tc.cause) > 0 {
+				require.IsType(t, &WaitError{}, err)
+				assert.Equal(t, tc.cause, err.(*WaitError).Failures[0].Cause)
+			} else {
+				require.NoError(t, err)
+				assert.Equal(t, tc.digest.String(), cache.Files[server.URL].Digest)
+			}
+
+			if len(tc.content) > 0 {
+				assert.Equal(t, tc.content, mustReadFile(t, cachePath))
+			} else {
+				assert.False(t, fs.Exists(cachePath))
+			}
+		})
+	}
+}
+
+func TestCache_Verify(t *testing.T) {
+	cases := map[string]struct {
+		action VerifyAction
+
+		content string
+	}{
+		"evict":      {Evict, ""},
+		"redownload": {Redownload, "content"},
+	}
+
+	for name, tc := range cases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				_, _ = w.Write([]byte("content"))
+			}))
+			defer server.Close()
+
+			dir := mustTempDir(t)
+			defer os.RemoveAll(dir)
+
+			good := filepath.Join(dir, "good.txt")
+			bad := filepath.Join(dir, "bad.txt")
+			missing := filepath.Join(dir, "missing.txt")
+
+			cache := NewCache(filepath.Join(dir, "meta.json"))
+			cache.FetchVerified(server.URL+"/good", good, Digest{SHA256, contentSHA256})
+			cache.Fetch(server.URL+"/bad", bad)
+			cache.Fetch(server.URL+"/missing", missing)
+			require.NoError(t, cache.Wait())
+			cache.Files["http://unknown"] = &CacheMeta{Saved: filepath.Join(dir, "unknown.txt")}
+
+			require.NoError(t, ioutil.WriteFile(bad, []byte("corrupted"), 0644))
+			require.NoError(t, os.Remove(missing))
+
+			corrupted := cache.Verify(tc.action)
+			require.NoError(t, cache.Wait())
+
+			assert.Equal(t, []string{server.URL + "/bad", server.URL + "/missing"}, corrupted)
+			assert.Equal(t, "content", mustReadFile(t, good))
+			if len(tc.content) > 0 {
+				assert.Equal(t, tc.content, mustReadFile(t, bad))
+				assert.Equal(t, tc.content, mustReadFile(t, missing))
+				assert.Contains(t, cache.Files, server.URL+"/bad")
+			} else {
+				assert.False(t, fs.Exists(bad))
+				assert.NotContains(t, cache.Files, server.URL+"/bad")
+				assert.NotContains(t, cache.Files, server.URL+"/missing")
+			}
+		})
+	}
+}
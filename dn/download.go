@@ -0,0 +1,242 @@
+package dn
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	"github.com/BakerHub/trivial/fs"
+)
+
+// tempFileFor creates the temporary file of a download next to pathname, so that it is renamed into place on
+// the same file system.
+func tempFileFor(pathname string) (*os.File, error) {
+	dir := filepath.Dir(pathname)
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return nil, err
+	}
+	return ioutil.TempFile(dir, filepath.Base(pathname)+".*.tmp")
+}
+
+func shouldRemove(file string) {
+	if !fs.Exists(file) {
+		return
+	}
+
+	err := os.Remove(file)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+func shouldClose(file io.Closer) {
+	err := file.Close()
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+func move(oldLocation, newLocation string) error {
+	var err error
+	if fs.Exists(newLocation) {
+		err = os.Remove(newLocation)
+
+	} else {
+		err = os.MkdirAll(path.Dir(newLocation), 0750)
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(oldLocation, newLocation)
+}
+
+type download struct {
+	status       int
+	bytes        int64
+	retries      int
+	etag         string
+	lastModified string
+	notModified  bool
+	mirror       string
+	header       http.Header
+	request      http.Header
+}
+
+func newRequest(url string, validators *CacheMeta) (*http.Request, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if validators == nil {
+		return req, nil
+	}
+	if len(validators.ETag) > 0 {
+		req.Header.Set("If-None-Match", validators.ETag)
+	}
+	if len(validators.LastModified) > 0 {
+		req.Header.Set("If-Modified-Since", validators.LastModified)
+	}
+	return req, nil
+}
+
+// downloadFile saves t.url to t.path, when t.validators is not nil a conditional request is sent. The file
+// at t.path is only replaced by a 2xx response matching t.digest, anything else leaves the previous copy
+// untouched. Urls of a scheme registered with Scheme are fetched by its Fetcher.
+func (cache *Cache) downloadFile(t *task) (*download, error) {
+	url, savePath, validators := t.url, t.path, t.validators
+	fail := func(cause Cause, err error) (*download, error) {
+		if cause == CauseNetwork && t.ctx.Err() != nil {
+			cause, err = CauseCanceled, t.ctx.Err()
+		}
+		return nil, &DownloadError{URL: url, Path: savePath, Cause: cause, Err: err}
+	}
+	if cache.offline {
+		return fail(CauseOffline, ErrNotCached)
+	}
+	if err := t.ctx.Err(); err != nil {
+		return fail(CauseCanceled, err)
+	}
+
+	ctx := t.ctx
+	if cache.transferTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cache.transferTimeout)
+		defer cancel()
+	}
+	if fetcher := cache.fetcherOf(url); fetcher != nil {
+		return cache.fetchFile(ctx, t, fetcher)
+	}
+
+	req, err := newRequest(url, validators)
+	if err != nil {
+		return fail(CauseRequest, err)
+	}
+	req = req.WithContext(ctx)
+	if err := cache.prepare(req); err != nil {
+		return fail(CauseRequest, err)
+	}
+
+	var part *partial
+	var offset int64
+	if cache.resume {
+		part = loadPartial(url, savePath)
+		offset = part.offset()
+		if offset > 0 {
+			part.setRange(req, offset)
+		}
+	}
+
+	resp, err := cache.client.Do(req)
+	if err != nil {
+		return fail(CauseNetwork, err)
+	}
+	defer shouldClose(resp.Body)
+
+	if validators != nil && resp.StatusCode == http.StatusNotModified {
+		return &download{
+			status:       resp.StatusCode,
+			etag:         validators.ETag,
+			lastModified: validators.LastModified,
+			notModified:  true,
+			header:       resp.Header,
+			request:      req.Header,
+		}, nil
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		if resp.StatusCode == http.StatusRequestedRangeNotSatisfiable && part != nil {
+			part.discard()
+		}
+		return fail(CauseStatus, &StatusError{
+			StatusCode: resp.StatusCode,
+			Status:     resp.Status,
+			RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()),
+		})
+	}
+
+	resumed := resp.StatusCode == http.StatusPartialContent
+	if resumed && (offset == 0 || contentRangeStart(resp.Header.Get("Content-Range")) != offset) {
+		if part != nil {
+			part.discard()
+		}
+		return fail(CauseStatus, &StatusError{StatusCode: resp.StatusCode, Status: resp.Status})
+	}
+
+	var out *os.File
+	if part == nil {
+		out, err = tempFileFor(savePath)
+	} else {
+		out, err = part.open(resp, resumed)
+	}
+	if err != nil {
+		return fail(CauseDisk, err)
+	}
+
+	var start, total int64
+	if resumed {
+		start = offset
+	}
+	if resp.ContentLength >= 0 {
+		total = start + resp.ContentLength
+	}
+
+	// Write the body to file
+	n, err := io.Copy(out, cache.trackProgress(t, resp.Body, start, total))
+	shouldClose(out)
+
+	if err != nil {
+		if part == nil {
+			shouldRemove(out.Name())
+		} else if len(part.validator()) == 0 {
+			part.discard()
+		}
+		return fail(CauseNetwork, err)
+	}
+
+	if t.digest != nil {
+		if err := t.digest.Check(out.Name()); err != nil {
+			if part == nil {
+				shouldRemove(out.Name())
+			} else {
+				part.discard()
+			}
+			if _, ok := err.(*ChecksumError); ok {
+				return fail(CauseChecksum, err)
+			}
+			return fail(CauseDisk, err)
+		}
+	}
+
+	err = move(out.Name(), savePath)
+	if part == nil {
+		shouldRemove(out.Name())
+	} else {
+		part.discard()
+	}
+	if err != nil {
+		return fail(CauseDisk, err)
+	}
+
+	result := &download{
+		status:       http.StatusOK,
+		bytes:        n,
+		header:       resp.Header,
+		request:      req.Header,
+		etag:         resp.Header.Get("ETag"),
+		lastModified: resp.Header.Get("Last-Modified"),
+	}
+	if !resumed {
+		result.status = resp.StatusCode
+	}
+	if part != nil && len(result.etag) == 0 && len(result.lastModified) == 0 {
+		result.etag, result.lastModified = part.ETag, part.LastModified
+	}
+	return result, nil
+}
@@ -0,0 +1,117 @@
+package dn
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Cause tells which step of a download failed.
+type Cause string
+
+const (
+	// CauseRequest means the request could not be built, for example because of an invalid url.
+	CauseRequest Cause = "request"
+	// CauseNetwork means the request could not be sent or the response could not be read.
+	CauseNetwork Cause = "network"
+	// CauseStatus means the server answered with an unexpected status code.
+	CauseStatus Cause = "status"
+	// CauseDisk means the downloaded content could not be written to the cache.
+	CauseDisk Cause = "disk"
+	// CauseChecksum means the downloaded content does not match the expected digest.
+	CauseChecksum Cause = "checksum"
+	// CauseCanceled means the context of the download was canceled or its deadline exceeded.
+	CauseCanceled Cause = "canceled"
+	// CauseOffline means the file is not cached and the cache is offline, its Err is ErrNotCached.
+	CauseOffline Cause = "offline"
+	// CauseExtract means the downloaded archive could not be extracted, see Extract.
+	CauseExtract Cause = "extract"
+)
+
+// ErrNotCached is the Err of a DownloadError for a file that is needed while the cache is offline.
+var ErrNotCached = errors.New("not in the cache")
+
+// DownloadError records a failed download of URL to Path.
+type DownloadError struct {
+	URL     string
+	Path    string
+	Cause   Cause
+	Err     error
+	Retries int
+}
+
+func (e *DownloadError) Error() string {
+	return fmt.Sprintf("download %s to %s: %s: %v", e.URL, e.Path, e.Cause, e.Err)
+}
+
+// StatusCode returns the status code of the response that made the download fail, 0 when the failure was
+// not caused by the response status.
+func (e *DownloadError) StatusCode() int {
+	if status, ok := e.Err.(*StatusError); ok {
+		return status.StatusCode
+	}
+	return 0
+}
+
+// downloadErrorOf returns err as a *DownloadError, other errors are network failures of url.
+func downloadErrorOf(url string, path string, err error) *DownloadError {
+	if failure, ok := err.(*DownloadError); ok {
+		return failure
+	}
+	return &DownloadError{URL: url, Path: path, Cause: CauseNetwork, Err: err}
+}
+
+// StatusError is the Err of a DownloadError caused by a non-2xx response.
+type StatusError struct {
+	StatusCode int
+	Status     string
+	// RetryAfter is the wait requested by the Retry-After header of the response.
+	RetryAfter time.Duration
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("unexpected status %s", e.Status)
+}
+
+// ChecksumError is the Err of a DownloadError caused by content not matching the expected digest.
+type ChecksumError struct {
+	Expected Digest
+	Actual   string
+}
+
+func (e *ChecksumError) Error() string {
+	return fmt.Sprintf("checksum mismatch: expected %s, got %s:%s", e.Expected, e.Expected.Algorithm, e.Actual)
+}
+
+// WaitError is returned by Cache.Wait and lists every download that failed.
+type WaitError struct {
+	Failures []*DownloadError
+	// MetaErr is the error of saving the meta file, if any.
+	MetaErr error
+}
+
+func (e *WaitError) Error() string {
+	messages := make([]string, 0, len(e.Failures))
+	for _, failure := range e.Failures {
+		messages = append(messages, failure.Error())
+	}
+	if e.MetaErr != nil {
+		messages = append(messages, "save meta: "+e.MetaErr.Error())
+	}
+	return fmt.Sprintf("%d download(s) failed:\n%s", len(e.Failures), strings.Join(messages, "\n"))
+}
+
+// MirrorError is the Err of a DownloadError for a Resource whose mirrors all failed, Failures are in the order
+// the mirrors were tried.
+type MirrorError struct {
+	Failures []*DownloadError
+}
+
+func (e *MirrorError) Error() string {
+	messages := make([]string, 0, len(e.Failures))
+	for _, failure := range e.Failures {
+		messages = append(messages, failure.Error())
+	}
+	return fmt.Sprintf("all %d mirror(s) failed: %s", len(e.Failures), strings.Join(messages, "; "))
+}
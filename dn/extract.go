@@ -0,0 +1,448 @@
+package dn
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/BakerHub/trivial/fs"
+)
+
+// Extraction records an archive unpacked by the Extract option.
+type Extraction struct {
+	Dir string `json:"dir"`
+	// Digest is the digest of the archive the tree was extracted from.
+	Digest string `json:"digest"`
+	// Size and ModTime are the ones of the archive when Digest was computed, it is reused while they match.
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modTime"`
+	// Tree lists the extracted files, directories and links relative to Dir, with slashes.
+	Tree []string `json:"tree,omitempty"`
+}
+
+// Extract unpacks the fetched tar, tar.gz and zip archives into ExtractedDir of their cache path, Result.Dir
+// tells where. The archive is only extracted again when its digest changed, and an existing path the cache did
+// not extract is never replaced. Entries escaping the directory,
+// directly or through a symbolic link, and dangling links fail the extraction with CauseExtract.
+func Extract() Option {
+	return func(cache *Cache) {
+		cache.extract = true
+	}
+}
+
+type archiveFormat int
+
+const (
+	notArchive archiveFormat = iota
+	tarArchive
+	tarGzArchive
+	zipArchive
+)
+
+var archiveExtensions = []struct {
+	ext    string
+	format archiveFormat
+}{
+	{".tar.gz", tarGzArchive},
+	{".tgz", tarGzArchive},
+	{".tar", tarArchive},
+	{".zip", zipArchive},
+}
+
+func formatOf(archive string) (archiveFormat, string) {
+	name := strings.ToLower(archive)
+	for _, e := range archiveExtensions {
+		if strings.HasSuffix(name, e.ext) {
+			return e.format, e.ext
+		}
+	}
+	return notArchive, ""
+}
+
+// ExtractedDir returns the directory the archive at cachePath is extracted to, its path with a .d suffix.
+func ExtractedDir(cachePath string) string {
+	return cachePath + ".d"
+}
+
+// extractResult extracts the archive of a successful result, a failed extraction fails the result.
+func (cache *Cache) extractResult(url string, result Result) Result {
+	dir, err := cache.extractArchive(url, result.Path)
+	if err != nil {
+		failure := &DownloadError{URL: url, Path: result.Path, Cause: CauseExtract, Err: err}
+		cache.addFailure(url, result.Path, failure)
+		return Result{URL: url, Path: result.Path, Retries: result.Retries, Err: failure}
+	}
+	result.Dir = dir
+	return result
+}
+
+// extractArchive extracts the archive of url unless the same archive was extracted already, it returns the
+// directory of the tree, empty when the file is not an archive.
+func (cache *Cache) extractArchive(url string, archive string) (string, error) {
+	format, _ := formatOf(archive)
+	if format == notArchive {
+		return "", nil
+	}
+
+	info, err := os.Stat(archive)
+	if err != nil {
+		return "", err
+	}
+	dir := ExtractedDir(archive)
+
+	var previous *Extraction
+	cache.mux.Lock()
+	if meta, ok := cache.Files[url]; ok && meta.Extracted != nil {
+		extracted := *meta.Extracted
+		previous = &extracted
+	}
+	cache.mux.Unlock()
+
+	extracted := previous != nil && previous.Dir == dir && fs.Exists(dir)
+	if extracted && previous.Size == info.Size() && previous.ModTime.Equal(info.ModTime()) {
+		return dir, nil
+	}
+
+	sum, err := fs.NewFileHashSHA256().FromFile(archive)
+	if err != nil {
+		return "", err
+	}
+	extraction := &Extraction{
+		Dir:     dir,
+		Digest:  Digest{Algorithm: SHA256, Hex: sum}.String(),
+		Size:    info.Size(),
+		ModTime: info.ModTime(),
+	}
+
+	if extracted && previous.Digest == extraction.Digest {
+		extraction.Tree = previous.Tree
+	} else {
+		if _, err := os.Lstat(dir); err == nil && !extracted {
+			return "", fmt.Errorf("%s exists and was not extracted by the cache", dir)
+		}
+		if extraction.Tree, err = extractTree(format, archive, dir); err != nil {
+			return "", err
+		}
+	}
+
+	cache.mux.Lock()
+	if meta, ok := cache.Files[url]; ok {
+		meta.Extracted = extraction
+	}
+	cache.mux.Unlock()
+	return dir, nil
+}
+
+// extractTree extracts archive next to dir and replaces dir once every entry is written.
+func extractTree(format archiveFormat, archive string, dir string) ([]string, error) {
+	parent := filepath.Dir(dir)
+	if err := os.MkdirAll(parent, 0750); err != nil {
+		return nil, err
+	}
+	tmp, err := ioutil.TempDir(parent, filepath.Base(dir)+".*.tmp")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmp)
+
+	x := &extractor{root: tmp}
+	if format == zipArchive {
+		err = x.zip(archive)
+	} else {
+		err = x.tar(archive, format == tarGzArchive)
+	}
+	if err == nil {
+		err = x.checkLinks()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmp, dir); err != nil {
+		return nil, err
+	}
+	sort.Strings(x.tree)
+	return x.tree, nil
+}
+
+// extractor writes the entries of an archive below root.
+type extractor struct {
+	root  string
+	tree  []string
+	links []string
+}
+
+// target returns where the entry name is written, it fails for names leaving root and for names whose parent
+// directories are symbolic links.
+func (x *extractor) target(name string) (string, error) {
+	rel, err := safeRel(name)
+	if err != nil {
+		return "", err
+	}
+	path := x.root
+	parts := strings.Split(rel, "/")
+	for _, part := range parts[:len(parts)-1] {
+		path = filepath.Join(path, part)
+		info, err := os.Lstat(path)
+		if os.IsNotExist(err) {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return "", fmt.Errorf("archive entry %s is below the symbolic link %s", name, part)
+		}
+	}
+	return filepath.Join(x.root, filepath.FromSlash(rel)), nil
+}
+
+// safeRel cleans an entry name, names that are absolute or leave the archive root fail.
+func safeRel(name string) (string, error) {
+	slashed := strings.Replace(name, `\`, "/", -1)
+	if strings.HasPrefix(slashed, "/") || filepath.VolumeName(name) != "" {
+		return "", fmt.Errorf("archive entry %s has an absolute path", name)
+	}
+	rel := strings.TrimSuffix(filepath.ToSlash(filepath.Clean(filepath.FromSlash(slashed))), "/")
+	if rel == "." || rel == ".." || strings.HasPrefix(rel, "../") {
+		return "", fmt.Errorf("archive entry %s leaves the extraction directory", name)
+	}
+	return rel, nil
+}
+
+func (x *extractor) record(name string) {
+	rel, _ := safeRel(name)
+	x.tree = append(x.tree, rel)
+}
+
+func (x *extractor) dir(name string, mode os.FileMode) error {
+	path, err := x.target(name)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(path, mode.Perm()|0700); err != nil {
+		return err
+	}
+	x.record(name)
+	return nil
+}
+
+func (x *extractor) file(name string, mode os.FileMode, content io.Reader) error {
+	path, err := x.target(name)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0750); err != nil {
+		return err
+	}
+	if err := removeLink(path); err != nil {
+		return err
+	}
+
+	out, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, mode.Perm()|0600) // #nosec
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, content)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	x.record(name)
+	return nil
+}
+
+// symlink creates a symbolic link, its target must stay below root.
+func (x *extractor) symlink(name string, target string) error {
+	path, err := x.target(name)
+	if err != nil {
+		return err
+	}
+	if filepath.IsAbs(target) || strings.HasPrefix(strings.Replace(target, `\`, "/", -1), "/") {
+		return fmt.Errorf("archive link %s points to the absolute path %s", name, target)
+	}
+	rel, _ := safeRel(name)
+	if _, err := safeRel(filepath.ToSlash(filepath.Join(filepath.Dir(filepath.FromSlash(rel)), target))); err != nil {
+		return fmt.Errorf("archive link %s points outside of the extraction directory: %s", name, target)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0750); err != nil {
+		return err
+	}
+	if err := removeLink(path); err != nil {
+		return err
+	}
+	if err := os.Symlink(target, path); err != nil {
+		return err
+	}
+	x.links = append(x.links, path)
+	x.record(name)
+	return nil
+}
+
+// checkLinks resolves the extracted symbolic links, a link escaping root through other links or pointing to
+// a missing file fails.
+func (x *extractor) checkLinks() error {
+	root, err := filepath.EvalSymlinks(x.root)
+	if err != nil {
+		return err
+	}
+	for _, link := range x.links {
+		resolved, err := filepath.EvalSymlinks(link)
+		if err != nil {
+			return fmt.Errorf("archive link %s can not be resolved: %v", link, err)
+		}
+		rel, err := filepath.Rel(root, resolved)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return fmt.Errorf("archive link %s points outside of the extraction directory", link)
+		}
+	}
+	return nil
+}
+
+// hardlink links name to the entry target extracted before it.
+func (x *extractor) hardlink(name string, target string) error {
+	path, err := x.target(name)
+	if err != nil {
+		return err
+	}
+	source, err := x.target(target)
+	if err != nil {
+		return err
+	}
+	info, err := os.Lstat(source)
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("archive link %s points to %s which is not a regular file", name, target)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0750); err != nil {
+		return err
+	}
+	if err := removeLink(path); err != nil {
+		return err
+	}
+	if err := os.Link(source, path); err != nil {
+		return err
+	}
+	x.record(name)
+	return nil
+}
+
+// removeLink removes a symbolic link written by a previous entry of the same name, so that the entry does not
+// write through it.
+func removeLink(path string) error {
+	info, err := os.Lstat(path)
+	if err != nil || info.Mode()&os.ModeSymlink == 0 {
+		return nil
+	}
+	return os.Remove(path)
+}
+
+func (x *extractor) tar(archive string, gzipped bool) error {
+	file, err := os.Open(archive) // #nosec
+	if err != nil {
+		return err
+	}
+	defer shouldClose(file)
+
+	var r io.Reader = file
+	if gzipped {
+		gz, err := gzip.NewReader(file)
+		if err != nil {
+			return err
+		}
+		defer shouldClose(gz)
+		r = gz
+	}
+
+	in := tar.NewReader(r)
+	for {
+		header, err := in.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		mode := header.FileInfo().Mode()
+		switch header.Typeflag {
+		case tar.TypeDir:
+			err = x.dir(header.Name, mode)
+		case tar.TypeReg, tar.TypeRegA:
+			err = x.file(header.Name, mode, in)
+		case tar.TypeSymlink:
+			err = x.symlink(header.Name, header.Linkname)
+		case tar.TypeLink:
+			err = x.hardlink(header.Name, header.Linkname)
+		default:
+			// devices, fifos and extended headers have no place in a cache
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (x *extractor) zip(archive string) error {
+	in, err := zip.OpenReader(archive)
+	if err != nil {
+		return err
+	}
+	defer shouldClose(in)
+
+	for _, entry := range in.File {
+		mode := entry.Mode()
+		switch {
+		case mode.IsDir():
+			err = x.dir(entry.Name, mode)
+		case mode&os.ModeSymlink != 0:
+			err = x.zipSymlink(entry)
+		case mode.IsRegular():
+			err = x.zipFile(entry)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (x *extractor) zipFile(entry *zip.File) error {
+	content, err := entry.Open()
+	if err != nil {
+		return err
+	}
+	defer shouldClose(content)
+	return x.file(entry.Name, entry.Mode(), content)
+}
+
+func (x *extractor) zipSymlink(entry *zip.File) error {
+	content, err := entry.Open()
+	if err != nil {
+		return err
+	}
+	defer shouldClose(content)
+
+	target, err := ioutil.ReadAll(io.LimitReader(content, 4096))
+	if err != nil {
+		return err
+	}
+	return x.symlink(entry.Name, string(target))
+}
@@ -0,0 +1,381 @@
+package dn
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/BakerHub/trivial/fs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type archiveEntry struct {
+	name string
+	kind byte
+	body string
+}
+
+func tarBytes(t *testing.T, gzipped bool, entries ...archiveEntry) []byte {
+	var buf bytes.Buffer
+	var gz *gzip.Writer
+	out := tar.NewWriter(&buf)
+	if gzipped {
+		gz = gzip.NewWriter(&buf)
+		out = tar.NewWriter(gz)
+	}
+	for _, e := range entries {
+		header := &tar.Header{Name: e.name, Typeflag: e.kind, Mode: 0644}
+		switch e.kind {
+		case tar.TypeReg:
+			header.Size = int64(len(e.body))
+		case tar.TypeDir:
+			header.Mode = 0755
+		default:
+			header.Linkname = e.body
+		}
+		require.NoError(t, out.WriteHeader(header))
+		if e.kind == tar.TypeReg {
+			_, err := out.Write([]byte(e.body))
+			require.NoError(t, err)
+		}
+	}
+	require.NoError(t, out.Close())
+	if gz != nil {
+		require.NoError(t, gz.Close())
+	}
+	return buf.Bytes()
+}
+
+func zipBytes(t *testing.T, entries ...archiveEntry) []byte {
+	var buf bytes.Buffer
+	out := zip.NewWriter(&buf)
+	for _, e := range entries {
+		header := &zip.FileHeader{Name: e.name}
+		header.SetMode(0644)
+		if e.kind == tar.TypeSymlink {
+			header.SetMode(os.ModeSymlink | 0777)
+		}
+		w, err := out.CreateHeader(header)
+		require.NoError(t, err)
+		_, err = w.Write([]byte(e.body))
+		require.NoError(t, err)
+	}
+	require.NoError(t, out.Close())
+	return buf.Bytes()
+}
+
+func TestSafeRel(t *testing.T) {
+	cases := map[string]struct {
+		name string
+
+		want string
+		ok   bool
+	}{
+		"file":      {"a/b.txt", "a/b.txt", true},
+		"directory": {"a/b/", "a/b", true},
+		"dot":       {"./a/./b", "a/b", true},
+		"inner up":  {"a/../b", "b", true},
+		"up":        {"../a", "", false},
+		"hidden up": {"a/../../b", "", false},
+		"absolute":  {"/etc/passwd", "", false},
+		"backslash": {`..\a`, "", false},
+		"root":      {"./", "", false},
+	}
+
+	for name, tc := range cases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			got, err := safeRel(tc.name)
+			if !tc.ok {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.want, got)
+		})
+	}
+}
+
+func TestExtractedDir(t *testing.T) {
+	assert.Equal(t, "cache/go1.12.tar.gz.d", ExtractedDir("cache/go1.12.tar.gz"))
+	assert.Equal(t, "cache/tool.ZIP.d", ExtractedDir("cache/tool.ZIP"))
+}
+
+func TestExtractTree(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("symbolic links need privileges")
+	}
+
+	cases := map[string]struct {
+		format  archiveFormat
+		archive func(t *testing.T) []byte
+
+		tree []string
+		ok   bool
+	}{
+		"tar": {
+			tarArchive,
+			func(t *testing.T) []byte {
+				return tarBytes(t, false,
+					archiveEntry{"bin/", tar.TypeDir, ""},
+					archiveEntry{"bin/tool", tar.TypeReg, "tool"},
+					archiveEntry{"latest", tar.TypeSymlink, "bin/tool"},
+					archiveEntry{"bin/copy", tar.TypeLink, "bin/tool"},
+				)
+			},
+			[]string{"bin", "bin/copy", "bin/tool", "latest"},
+			true,
+		},
+		"zip": {
+			zipArchive,
+			func(t *testing.T) []byte {
+				return zipBytes(t,
+					archiveEntry{"lib/a.txt", tar.TypeReg, "a"},
+					archiveEntry{"link", tar.TypeSymlink, "lib/a.txt"},
+				)
+			},
+			[]string{"lib/a.txt", "link"},
+			true,
+		},
+		"traversal": {
+			tarArchive,
+			func(t *testing.T) []byte {
+				return tarBytes(t, false, archiveEntry{"../evil", tar.TypeReg, "evil"})
+			},
+			nil,
+			false,
+		},
+		"zip traversal": {
+			zipArchive,
+			func(t *testing.T) []byte {
+				return zipBytes(t, archiveEntry{"a/../../evil", tar.TypeReg, "evil"})
+			},
+			nil,
+			false,
+		},
+		"absolute": {
+			tarArchive,
+			func(t *testing.T) []byte {
+				return tarBytes(t, false, archiveEntry{"/tmp/evil", tar.TypeReg, "evil"})
+			},
+			nil,
+			false,
+		},
+		"absolute link": {
+			tarArchive,
+			func(t *testing.T) []byte {
+				return tarBytes(t, false, archiveEntry{"etc", tar.TypeSymlink, "/etc"})
+			},
+			nil,
+			false,
+		},
+		"escaping link": {
+			zipArchive,
+			func(t *testing.T) []byte {
+				return zipBytes(t, archiveEntry{"a/up", tar.TypeSymlink, "../../evil"})
+			},
+			nil,
+			false,
+		},
+		"write through link": {
+			tarArchive,
+			func(t *testing.T) []byte {
+				return tarBytes(t, false,
+					archiveEntry{"sub/", tar.TypeDir, ""},
+					archiveEntry{"link", tar.TypeSymlink, "sub"},
+					archiveEntry{"link/evil", tar.TypeReg, "evil"},
+				)
+			},
+			nil,
+			false,
+		},
+		"chained links": {
+			tarArchive,
+			func(t *testing.T) []byte {
+				return tarBytes(t, false,
+					archiveEntry{"a/b/", tar.TypeDir, ""},
+					archiveEntry{"a/b/l", tar.TypeSymlink, ".."},
+					archiveEntry{"e", tar.TypeSymlink, "a/b/l/../.."},
+					archiveEntry{"h", tar.TypeSymlink, "e/../evil"},
+				)
+			},
+			nil,
+			false,
+		},
+		"hard link outside": {
+			tarArchive,
+			func(t *testing.T) []byte {
+				return tarBytes(t, false, archiveEntry{"passwd", tar.TypeLink, "../../../etc/passwd"})
+			},
+			nil,
+			false,
+		},
+	}
+
+	for name, tc := range cases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			dir := mustTempDir(t)
+			defer os.RemoveAll(dir)
+
+			archive := filepath.Join(dir, "archive")
+			require.NoError(t, ioutil.WriteFile(archive, tc.archive(t), 0644))
+			target := filepath.Join(dir, "out", "tree")
+
+			tree, err := extractTree(tc.format, archive, target)
+			entries, readErr := ioutil.ReadDir(filepath.Join(dir, "out"))
+			require.NoError(t, readErr)
+			assert.False(t, fs.Exists(filepath.Join(dir, "evil")))
+
+			if !tc.ok {
+				assert.Error(t, err)
+				assert.Empty(t, entries, "nothing is left behind")
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.tree, tree)
+			assert.Len(t, entries, 1)
+			for _, rel := range tc.tree {
+				_, err := os.Lstat(filepath.Join(target, filepath.FromSlash(rel)))
+				assert.NoError(t, err, rel)
+			}
+		})
+	}
+}
+
+func TestCache_Fetch_extract(t *testing.T) {
+	var mux sync.Mutex
+	etag := `"v1"`
+	archive := tarBytes(t, true, archiveEntry{"go/VERSION", tar.TypeReg, "go1.12"})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mux.Lock()
+		defer mux.Unlock()
+		w.Header().Set("ETag", etag)
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		_, _ = w.Write(archive)
+	}))
+	defer server.Close()
+
+	dir := mustTempDir(t)
+	defer os.RemoveAll(dir)
+	metaFile := filepath.Join(dir, "meta.json")
+	cachePath := filepath.Join(dir, "go1.12.tar.gz")
+	extracted := filepath.Join(dir, "go1.12.tar.gz.d")
+	version := filepath.Join(extracted, "go", "VERSION")
+
+	cache := NewCache(metaFile, Extract())
+	got := cache.Fetch(server.URL, cachePath).Wait()
+	require.NoError(t, cache.Wait())
+	assert.Equal(t, extracted, got.Dir)
+	assert.Equal(t, "go1.12", mustReadFile(t, version))
+	extraction := NewCache(metaFile).Files[server.URL].Extracted
+	require.NotNil(t, extraction)
+	assert.Equal(t, []string{"go/VERSION"}, extraction.Tree)
+
+	// the same archive is not extracted again
+	require.NoError(t, ioutil.WriteFile(version, []byte("edited"), 0644))
+	cache = NewCache(metaFile, Extract(), Revalidate())
+	got = cache.Fetch(server.URL, cachePath).Wait()
+	require.NoError(t, cache.Wait())
+	assert.Equal(t, extracted, got.Dir)
+	assert.Equal(t, "edited", mustReadFile(t, version))
+
+	mux.Lock()
+	archive = tarBytes(t, true, archiveEntry{"go/VERSION", tar.TypeReg, "go1.13"})
+	etag = `"v2"`
+	mux.Unlock()
+	cache = NewCache(metaFile, Extract(), Revalidate())
+	got = cache.Fetch(server.URL, cachePath).Wait()
+	require.NoError(t, cache.Wait())
+	assert.Equal(t, "go1.13", mustReadFile(t, version))
+
+	assert.Len(t, cache.Prune(PrunePolicy{MaxSize: 1}), 1)
+	assert.False(t, fs.Exists(extracted))
+}
+
+func TestCache_Fetch_extractError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("not a zip"))
+	}))
+	defer server.Close()
+
+	dir := mustTempDir(t)
+	defer os.RemoveAll(dir)
+
+	cache := NewCache(filepath.Join(dir, "meta.json"), Extract())
+	got := cache.Fetch(server.URL, filepath.Join(dir, "tool.zip")).Wait()
+	err := cache.Wait()
+
+	require.IsType(t, &DownloadError{}, got.Err)
+	assert.Equal(t, CauseExtract, got.Err.(*DownloadError).Cause)
+	assert.Error(t, err)
+	assert.Empty(t, got.Dir)
+}
+
+func TestCache_Fetch_extractKeepsExistingPath(t *testing.T) {
+	dir := mustTempDir(t)
+	defer os.RemoveAll(dir)
+	cachePath := filepath.Join(dir, "tool.zip")
+	archive := "data:;base64," + base64.StdEncoding.EncodeToString(zipBytes(t, archiveEntry{"tool", tar.TypeReg, "tool"}))
+
+	// a file cached where the archive would be extracted
+	cache := NewCache(filepath.Join(dir, "meta.json"), Extract())
+	require.NoError(t, cache.Fetch("data:,precious", ExtractedDir(cachePath)).Wait().Err)
+	got := cache.Fetch(archive, cachePath).Wait()
+	assert.Error(t, cache.Wait())
+
+	require.IsType(t, &DownloadError{}, got.Err)
+	assert.Equal(t, CauseExtract, got.Err.(*DownloadError).Cause)
+	assert.Equal(t, "precious", mustReadFile(t, ExtractedDir(cachePath)))
+}
+
+func TestCache_Fetch_extractReusesDigest(t *testing.T) {
+	dir := mustTempDir(t)
+	defer os.RemoveAll(dir)
+	metaFile := filepath.Join(dir, "meta.json")
+	cachePath := filepath.Join(dir, "a.tar")
+	url := "data:;base64," + base64.StdEncoding.EncodeToString(tarBytes(t, false, archiveEntry{"a", tar.TypeReg, "a"}))
+
+	cache := NewCache(metaFile, Extract())
+	require.NoError(t, cache.Fetch(url, cachePath).Wait().Err)
+	require.NoError(t, cache.Wait())
+	info, err := os.Stat(cachePath)
+	require.NoError(t, err)
+	extraction := NewCache(metaFile).Files[url].Extracted
+	require.NotNil(t, extraction)
+	assert.Equal(t, info.Size(), extraction.Size)
+	assert.True(t, info.ModTime().Equal(extraction.ModTime))
+
+	// an archive with the recorded size and time is not hashed: a corrupted copy is not noticed
+	corrupted := tarBytes(t, false, archiveEntry{"b", tar.TypeReg, "b"})
+	require.NoError(t, ioutil.WriteFile(cachePath, corrupted, 0644))
+	require.NoError(t, os.Chtimes(cachePath, info.ModTime(), info.ModTime()))
+	cache = NewCache(metaFile, Extract())
+	got := cache.Fetch(url, cachePath).Wait()
+	require.NoError(t, got.Err)
+	assert.True(t, fs.Exists(filepath.Join(got.Dir, "a")))
+	assert.False(t, fs.Exists(filepath.Join(got.Dir, "b")))
+
+	// a changed time makes it hash the archive again
+	require.NoError(t, os.Chtimes(cachePath, info.ModTime(), info.ModTime().Add(time.Second)))
+	cache = NewCache(metaFile, Extract())
+	got = cache.Fetch(url, cachePath).Wait()
+	require.NoError(t, got.Err)
+	require.NoError(t, cache.Wait())
+	assert.True(t, fs.Exists(filepath.Join(got.Dir, "b")))
+}
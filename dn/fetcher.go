@@ -0,0 +1,188 @@
+package dn
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// Content is the content of a url returned by a Fetcher.
+type Content struct {
+	// Body is read to the end and closed by the cache, it is nil when NotModified is set.
+	Body io.ReadCloser
+	// Size is the length of Body for the progress reports, 0 when unknown.
+	Size int64
+	// ETag and LastModified are recorded in the meta and given back to the Fetcher as validators.
+	ETag         string
+	LastModified string
+	// NotModified means the content still matches the validators given to Fetch.
+	NotModified bool
+}
+
+// Fetcher downloads the urls of the schemes it is registered for with the Scheme option, see FileFetcher and
+// DataFetcher. The cache still handles retries, checksums and the meta of the fetched files.
+//
+// Fetch returns the content of rawURL, validators is the meta of the cached copy when it should only be
+// returned if it changed, nil otherwise. A *StatusError fails the download with CauseStatus and any other
+// error with CauseNetwork, a Fetcher returns a *DownloadError to pick the cause itself.
+type Fetcher interface {
+	Fetch(ctx context.Context, rawURL string, validators *CacheMeta) (*Content, error)
+}
+
+// FetcherFunc adapts a function to a Fetcher.
+type FetcherFunc func(ctx context.Context, rawURL string, validators *CacheMeta) (*Content, error)
+
+func (f FetcherFunc) Fetch(ctx context.Context, rawURL string, validators *CacheMeta) (*Content, error) {
+	return f(ctx, rawURL, validators)
+}
+
+// Scheme fetches the urls of scheme with fetcher, in place of the built-in one if any. The file and data
+// schemes are served by FileFetcher and DataFetcher unless replaced.
+func Scheme(scheme string, fetcher Fetcher) Option {
+	return func(cache *Cache) {
+		cache.fetchers[strings.ToLower(scheme)] = fetcher
+	}
+}
+
+// fetcherOf returns the Fetcher registered for the scheme of rawURL, nil for the urls sent over HTTP.
+func (cache *Cache) fetcherOf(rawURL string) Fetcher {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil
+	}
+	return cache.fetchers[u.Scheme]
+}
+
+// fetchFile saves the content returned by fetcher for t.url to t.path, like downloadFile does for HTTP.
+func (cache *Cache) fetchFile(ctx context.Context, t *task, fetcher Fetcher) (*download, error) {
+	fail := func(cause Cause, err error) (*download, error) {
+		if cause == CauseNetwork && t.ctx.Err() != nil {
+			cause, err = CauseCanceled, t.ctx.Err()
+		}
+		return nil, &DownloadError{URL: t.url, Path: t.path, Cause: cause, Err: err}
+	}
+
+	content, err := fetcher.Fetch(ctx, t.url, t.validators)
+	if err != nil {
+		switch e := err.(type) {
+		case *DownloadError:
+			return fail(e.Cause, e.Err)
+		case *StatusError:
+			return fail(CauseStatus, e)
+		}
+		return fail(CauseNetwork, err)
+	}
+	if content.NotModified && t.validators != nil {
+		return &download{
+			status:       http.StatusNotModified,
+			etag:         t.validators.ETag,
+			lastModified: t.validators.LastModified,
+			notModified:  true,
+		}, nil
+	}
+	if content.Body == nil {
+		return fail(CauseNetwork, fmt.Errorf("no content for %s", t.url))
+	}
+	defer shouldClose(content.Body)
+
+	out, err := tempFileFor(t.path)
+	if err != nil {
+		return fail(CauseDisk, err)
+	}
+	defer shouldRemove(out.Name())
+
+	n, err := io.Copy(out, cache.trackProgress(t, content.Body, 0, content.Size))
+	shouldClose(out)
+	if err != nil {
+		return fail(CauseNetwork, err)
+	}
+	if t.digest != nil {
+		if err := t.digest.Check(out.Name()); err != nil {
+			if _, ok := err.(*ChecksumError); ok {
+				return fail(CauseChecksum, err)
+			}
+			return fail(CauseDisk, err)
+		}
+	}
+	if err := move(out.Name(), t.path); err != nil {
+		return fail(CauseDisk, err)
+	}
+
+	return &download{
+		status:       http.StatusOK,
+		bytes:        n,
+		etag:         content.ETag,
+		lastModified: content.LastModified,
+	}, nil
+}
+
+// FileFetcher fetches file urls from the local file system, a missing file fails with a 404 StatusError.
+// The modification time of the file is its Last-Modified validator.
+func FileFetcher() Fetcher {
+	return FetcherFunc(func(ctx context.Context, rawURL string, validators *CacheMeta) (*Content, error) {
+		u, err := url.Parse(rawURL)
+		if err != nil {
+			return nil, &DownloadError{Cause: CauseRequest, Err: err}
+		}
+		if len(u.Host) > 0 && u.Host != "localhost" {
+			return nil, &DownloadError{Cause: CauseRequest, Err: fmt.Errorf("file url with remote host %s", u.Host)}
+		}
+
+		file, err := os.Open(u.Path) // #nosec
+		if os.IsNotExist(err) {
+			return nil, &StatusError{StatusCode: http.StatusNotFound, Status: "404 Not Found"}
+		}
+		if err != nil {
+			return nil, &DownloadError{Cause: CauseDisk, Err: err}
+		}
+		info, err := file.Stat()
+		if err != nil {
+			shouldClose(file)
+			return nil, &DownloadError{Cause: CauseDisk, Err: err}
+		}
+
+		lastModified := info.ModTime().UTC().Format(http.TimeFormat)
+		if validators != nil && validators.LastModified == lastModified {
+			shouldClose(file)
+			return &Content{LastModified: lastModified, NotModified: true}, nil
+		}
+		return &Content{Body: file, Size: info.Size(), LastModified: lastModified}, nil
+	})
+}
+
+// DataFetcher fetches data urls (RFC 2397), their content is embedded in the url.
+func DataFetcher() Fetcher {
+	return FetcherFunc(func(ctx context.Context, rawURL string, validators *CacheMeta) (*Content, error) {
+		data, err := decodeDataURL(rawURL)
+		if err != nil {
+			return nil, &DownloadError{Cause: CauseRequest, Err: err}
+		}
+		return &Content{Body: ioutil.NopCloser(bytes.NewReader(data)), Size: int64(len(data))}, nil
+	})
+}
+
+func decodeDataURL(rawURL string) ([]byte, error) {
+	if !strings.HasPrefix(strings.ToLower(rawURL), "data:") {
+		return nil, fmt.Errorf("not a data url: %s", rawURL)
+	}
+	comma := strings.Index(rawURL, ",")
+	if comma < 0 {
+		return nil, fmt.Errorf("data url without a comma: %s", rawURL)
+	}
+
+	data, err := url.PathUnescape(rawURL[comma+1:])
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasSuffix(strings.ToLower(rawURL[:comma]), ";base64") {
+		return []byte(data), nil
+	}
+	return base64.StdEncoding.DecodeString(data)
+}
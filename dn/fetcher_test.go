@@ -0,0 +1,195 @@
+package dn
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDecodeDataURL(t *testing.T) {
+	cases := map[string]struct {
+		url string
+
+		want string
+		ok   bool
+	}{
+		"plain": {
+			"data:,hello%20world",
+			"hello world",
+			true,
+		},
+		"media type": {
+			"data:text/plain;charset=utf-8,a,b",
+			"a,b",
+			true,
+		},
+		"base64": {
+			"data:text/plain;base64,aGVsbG8=",
+			"hello",
+			true,
+		},
+		"invalid base64": {
+			"data:;base64,!!",
+			"",
+			false,
+		},
+		"no comma": {
+			"data:text/plain",
+			"",
+			false,
+		},
+		"not data": {
+			"http://example.com/,a",
+			"",
+			false,
+		},
+	}
+
+	for name, tc := range cases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			got, err := decodeDataURL(tc.url)
+			if !tc.ok {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.want, string(got))
+		})
+	}
+}
+
+func TestCache_Fetch_schemes(t *testing.T) {
+	dir := mustTempDir(t)
+	defer os.RemoveAll(dir)
+
+	source := filepath.Join(dir, "source.txt")
+	require.NoError(t, ioutil.WriteFile(source, []byte("from file"), 0644))
+
+	cases := map[string]struct {
+		url    string
+		digest string
+
+		want  string
+		cause Cause
+	}{
+		"file": {
+			"file://" + filepath.ToSlash(source),
+			"",
+			"from file",
+			"",
+		},
+		"missing file": {
+			"file://" + filepath.ToSlash(filepath.Join(dir, "missing.txt")),
+			"",
+			"",
+			CauseStatus,
+		},
+		"data": {
+			"data:;base64,aGVsbG8=",
+			"sha256:2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824",
+			"hello",
+			"",
+		},
+		"checksum": {
+			"data:,hello",
+			"sha256:0000000000000000000000000000000000000000000000000000000000000000",
+			"",
+			CauseChecksum,
+		},
+		"invalid data": {
+			"data:text/plain",
+			"",
+			"",
+			CauseRequest,
+		},
+	}
+
+	for name, tc := range cases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			cache := NewCache(filepath.Join(dir, name+".json"))
+			cachePath := filepath.Join(dir, name, "cached.txt")
+
+			var h *Handle
+			if len(tc.digest) > 0 {
+				digest, err := ParseDigest(tc.digest)
+				require.NoError(t, err)
+				h = cache.FetchVerified(tc.url, cachePath, digest)
+			} else {
+				h = cache.Fetch(tc.url, cachePath)
+			}
+			got := h.Wait()
+			err := cache.Wait()
+
+			if len(tc.cause) > 0 {
+				require.IsType(t, &DownloadError{}, got.Err)
+				assert.Equal(t, tc.cause, got.Err.(*DownloadError).Cause)
+				assert.Equal(t, 0, got.Err.(*DownloadError).Retries)
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, got.Err)
+			assert.NoError(t, err)
+			assert.Equal(t, tc.want, mustReadFile(t, cachePath))
+			assert.Contains(t, cache.Files, tc.url)
+		})
+	}
+}
+
+func TestCache_Fetch_fileRevalidate(t *testing.T) {
+	dir := mustTempDir(t)
+	defer os.RemoveAll(dir)
+
+	source := filepath.Join(dir, "source.txt")
+	require.NoError(t, ioutil.WriteFile(source, []byte("v1"), 0644))
+	url := "file://" + filepath.ToSlash(source)
+	metaFile := filepath.Join(dir, "meta.json")
+	cachePath := filepath.Join(dir, "cached.txt")
+
+	cache := NewCache(metaFile)
+	cache.Fetch(url, cachePath)
+	require.NoError(t, cache.Wait())
+
+	cache = NewCache(metaFile, Revalidate())
+	got := cache.Fetch(url, cachePath).Wait()
+	require.NoError(t, cache.Wait())
+	assert.True(t, got.Hit)
+	assert.Equal(t, http.StatusNotModified, cache.Files[url].Status)
+}
+
+func TestCache_Fetch_customScheme(t *testing.T) {
+	dir := mustTempDir(t)
+	defer os.RemoveAll(dir)
+
+	var calls int32
+	store := FetcherFunc(func(ctx context.Context, rawURL string, validators *CacheMeta) (*Content, error) {
+		atomic.AddInt32(&calls, 1)
+		if validators != nil && validators.ETag == "v1" {
+			return &Content{NotModified: true}, nil
+		}
+		return &Content{Body: ioutil.NopCloser(strings.NewReader(rawURL)), ETag: "v1"}, nil
+	})
+
+	metaFile := filepath.Join(dir, "meta.json")
+	cachePath := filepath.Join(dir, "a.txt")
+	cache := NewCache(metaFile, Scheme("Store", store))
+	cache.Fetch("store://bucket/a", cachePath)
+	require.NoError(t, cache.Wait())
+	assert.Equal(t, "store://bucket/a", mustReadFile(t, cachePath))
+	assert.Equal(t, "v1", cache.Files["store://bucket/a"].ETag)
+
+	cache = NewCache(metaFile, Scheme("store", store), Revalidate())
+	got := cache.Fetch("store://bucket/a", cachePath).Wait()
+	require.NoError(t, cache.Wait())
+	assert.True(t, got.Hit)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&calls))
+}
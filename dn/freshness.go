@@ -0,0 +1,244 @@
+package dn
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BakerHub/trivial/fs"
+)
+
+// Freshness makes the cache follow the HTTP caching rules of the responses (RFC 7234): a cached file is
+// used without contacting the server while it is fresh according to Cache-Control max-age or Expires,
+// revalidated once it is stale, and never kept in the meta when the response says no-store.
+func Freshness() Option {
+	return func(cache *Cache) {
+		cache.freshness = true
+	}
+}
+
+// StaleWhileRevalidate uses a stale file right away while it is within the stale-while-revalidate window
+// of its response, and revalidates it in the background. It implies Freshness.
+func StaleWhileRevalidate() Option {
+	return func(cache *Cache) {
+		cache.freshness = true
+		cache.staleWhileRevalidate = true
+	}
+}
+
+// StaleIfError keeps using a stale file when revalidating it fails with a network error or a 5xx response
+// within the stale-if-error window of its response. It implies Freshness.
+func StaleIfError() Option {
+	return func(cache *Cache) {
+		cache.freshness = true
+		cache.staleIfError = true
+	}
+}
+
+// parseCacheControl returns the directives of a Cache-Control header, names are lower case.
+func parseCacheControl(value string) map[string]string {
+	directives := make(map[string]string)
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		if len(part) == 0 {
+			continue
+		}
+		name, arg := part, ""
+		if i := strings.Index(part, "="); i >= 0 {
+			name, arg = part[:i], strings.Trim(strings.TrimSpace(part[i+1:]), `"`)
+		}
+		directives[strings.ToLower(strings.TrimSpace(name))] = arg
+	}
+	return directives
+}
+
+func directiveSeconds(directives map[string]string, name string) (time.Duration, bool) {
+	arg, ok := directives[name]
+	if !ok {
+		return 0, false
+	}
+	seconds, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil || seconds < 0 {
+		return 0, false
+	}
+	return time.Duration(seconds) * time.Second, true
+}
+
+// lifetime returns the freshness lifetime of the stored response, 0 when it has none.
+func (meta *CacheMeta) lifetime() time.Duration {
+	directives := parseCacheControl(meta.CacheControl)
+	if _, ok := directives["no-cache"]; ok {
+		return 0
+	}
+	if maxAge, ok := directiveSeconds(directives, "max-age"); ok {
+		return maxAge
+	}
+	if len(meta.Expires) == 0 {
+		return 0
+	}
+
+	expires, err := http.ParseTime(meta.Expires)
+	if err != nil {
+		return 0
+	}
+	date, err := http.ParseTime(meta.Date)
+	if err != nil {
+		date = meta.FetchedAt
+	}
+	if lifetime := expires.Sub(date); lifetime > 0 {
+		return lifetime
+	}
+	return 0
+}
+
+// age returns how old the stored response is at now, including the age it already had when it was fetched.
+func (meta *CacheMeta) age(now time.Time) time.Duration {
+	var apparent time.Duration
+	if date, err := http.ParseTime(meta.Date); err == nil && meta.FetchedAt.After(date) {
+		apparent = meta.FetchedAt.Sub(date)
+	}
+	return apparent + now.Sub(meta.FetchedAt)
+}
+
+// staleWithin reports whether the stored response is stale by less than the window of the given
+// Cache-Control directive.
+func (meta *CacheMeta) staleWithin(directive string, now time.Time) bool {
+	window, ok := directiveSeconds(parseCacheControl(meta.CacheControl), directive)
+	if !ok {
+		return false
+	}
+	return meta.age(now)-meta.lifetime() <= window
+}
+
+// recordHeaders stores the caching headers of a response, a 304 response only updates the ones it sends.
+func (meta *CacheMeta) recordHeaders(header http.Header, request http.Header, notModified bool) {
+	set := func(field *string, name string) {
+		if value := header.Get(name); len(value) > 0 || !notModified {
+			*field = value
+		}
+	}
+	set(&meta.CacheControl, "Cache-Control")
+	set(&meta.Expires, "Expires")
+	set(&meta.Date, "Date")
+	set(&meta.Vary, "Vary")
+
+	meta.VaryHeaders = nil
+	for _, name := range varyNames(meta.Vary) {
+		if meta.VaryHeaders == nil {
+			meta.VaryHeaders = make(map[string]string)
+		}
+		meta.VaryHeaders[name] = request.Get(name)
+	}
+}
+
+func varyNames(vary string) []string {
+	var names []string
+	for _, name := range strings.Split(vary, ",") {
+		if name = strings.TrimSpace(name); len(name) > 0 {
+			names = append(names, http.CanonicalHeaderKey(name))
+		}
+	}
+	return names
+}
+
+func noStore(header http.Header) bool {
+	_, ok := parseCacheControl(header.Get("Cache-Control"))["no-store"]
+	return ok
+}
+
+type freshnessState int
+
+const (
+	stale freshnessState = iota
+	fresh
+	staleRevalidating
+)
+
+// fetchFresh decides between the cached file of t and the server following the freshness of the cached
+// response, cached tells whether a file is cached at t.path.
+func (cache *Cache) fetchFresh(t *task, cached bool) *Handle {
+	h := t.handle
+	if !cached {
+		cache.start(t)
+		return h
+	}
+
+	switch cache.freshnessOf(t.url) {
+	case fresh:
+		cache.resolve(t.url, h, cache.hitResult(t.url, t.path))
+		return h
+	case staleRevalidating:
+		result := cache.hitResult(t.url, t.path)
+		result.Stale = true
+		cache.resolve(t.url, h, result)
+		t.handle = nil
+	}
+
+	t.validators = cache.validators(t.url, t.path)
+	cache.start(t)
+	return h
+}
+
+// freshnessOf tells whether the cached file of url can be used without asking the server.
+func (cache *Cache) freshnessOf(url string) freshnessState {
+	cache.mux.Lock()
+	meta, ok := cache.Files[url]
+	var stored CacheMeta
+	if ok {
+		stored = *meta
+	}
+	cache.mux.Unlock()
+
+	if !ok || stored.FetchedAt.IsZero() || !cache.varyMatches(url, &stored) {
+		return stale
+	}
+
+	now := time.Now()
+	if stored.age(now) < stored.lifetime() {
+		return fresh
+	}
+	if cache.staleWhileRevalidate && stored.staleWithin("stale-while-revalidate", now) {
+		return staleRevalidating
+	}
+	return stale
+}
+
+// varyMatches reports whether the request the cache sends for url selects the stored response.
+func (cache *Cache) varyMatches(url string, meta *CacheMeta) bool {
+	if len(varyNames(meta.Vary)) == 0 {
+		return true
+	}
+
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil || cache.prepare(req) != nil {
+		return false
+	}
+	return meta.varyMatches(req.Header)
+}
+
+// varyMatches reports whether a request with the given headers selects the stored response.
+func (meta *CacheMeta) varyMatches(request http.Header) bool {
+	for _, name := range varyNames(meta.Vary) {
+		if name == "*" || request.Get(name) != meta.VaryHeaders[name] {
+			return false
+		}
+	}
+	return true
+}
+
+// usableOnError reports whether the stale file of url may be used in place of a failed revalidation.
+func (cache *Cache) usableOnError(url string, cachePath string, failure *DownloadError) bool {
+	if !cache.staleIfError || !IsRetryable(failure) {
+		return false
+	}
+
+	cache.mux.Lock()
+	defer cache.mux.Unlock()
+
+	meta, ok := cache.Files[url]
+	if !ok || meta.Saved != cachePath || meta.FetchedAt.IsZero() {
+		return false
+	}
+	return meta.staleWithin("stale-if-error", time.Now()) && fs.Exists(cachePath)
+}
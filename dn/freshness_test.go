@@ -0,0 +1,281 @@
+package dn
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseCacheControl(t *testing.T) {
+	cases := map[string]struct {
+		value string
+
+		want map[string]string
+	}{
+		"empty": {
+			"",
+			map[string]string{},
+		},
+		"directives": {
+			`max-age=60, No-Store, private="Set-Cookie"`,
+			map[string]string{"max-age": "60", "no-store": "", "private": "Set-Cookie"},
+		},
+		"spaces": {
+			` max-age = 5 ,, public `,
+			map[string]string{"max-age": "5", "public": ""},
+		},
+	}
+
+	for name, tc := range cases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, tc.want, parseCacheControl(tc.value))
+		})
+	}
+}
+
+func TestCacheMeta_lifetime(t *testing.T) {
+	date := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	cases := map[string]struct {
+		meta CacheMeta
+
+		want time.Duration
+	}{
+		"none": {
+			CacheMeta{},
+			0,
+		},
+		"max age": {
+			CacheMeta{CacheControl: "max-age=60"},
+			time.Minute,
+		},
+		"max age over expires": {
+			CacheMeta{CacheControl: "max-age=60", Expires: date.Add(time.Hour).Format(http.TimeFormat), Date: date.Format(http.TimeFormat)},
+			time.Minute,
+		},
+		"expires": {
+			CacheMeta{Expires: date.Add(time.Hour).Format(http.TimeFormat), Date: date.Format(http.TimeFormat)},
+			time.Hour,
+		},
+		"expires without date": {
+			CacheMeta{Expires: date.Add(time.Hour).Format(http.TimeFormat), FetchedAt: date},
+			time.Hour,
+		},
+		"expired": {
+			CacheMeta{Expires: "0", Date: date.Format(http.TimeFormat)},
+			0,
+		},
+		"no cache": {
+			CacheMeta{CacheControl: "no-cache, max-age=60"},
+			0,
+		},
+	}
+
+	for name, tc := range cases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, tc.want, tc.meta.lifetime())
+		})
+	}
+}
+
+// freshnessServer serves content with the given Cache-Control header and counts the requests it gets,
+// conditional requests are answered with 304.
+func freshnessServer(cacheControl string, requests *int32, conditional *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(requests, 1)
+		w.Header().Set("Cache-Control", cacheControl)
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Vary", "Accept-Language")
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			atomic.AddInt32(conditional, 1)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		_, _ = w.Write([]byte("content"))
+	}))
+}
+
+func TestCache_Fetch_freshness(t *testing.T) {
+	cases := map[string]struct {
+		cacheControl string
+		age          time.Duration
+		language     string
+
+		requests    int32
+		conditional int32
+		stored      bool
+	}{
+		"fresh": {
+			"max-age=3600",
+			time.Minute,
+			"en",
+			1,
+			0,
+			true,
+		},
+		"stale": {
+			"max-age=60",
+			time.Hour,
+			"en",
+			2,
+			1,
+			true,
+		},
+		"no cache": {
+			"no-cache",
+			0,
+			"en",
+			2,
+			1,
+			true,
+		},
+		"vary mismatch": {
+			"max-age=3600",
+			time.Minute,
+			"fr",
+			2,
+			1,
+			true,
+		},
+		"no store": {
+			"no-store",
+			0,
+			"en",
+			2,
+			0,
+			false,
+		},
+	}
+
+	for name, tc := range cases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			var requests, conditional int32
+			server := freshnessServer(tc.cacheControl, &requests, &conditional)
+			defer server.Close()
+
+			dir := mustTempDir(t)
+			defer os.RemoveAll(dir)
+			metaFile := filepath.Join(dir, "meta.json")
+			cachePath := filepath.Join(dir, "a.txt")
+			url := server.URL + "/a.txt"
+
+			cache := NewCache(metaFile, Freshness(), HostHeader(hostOf(server.URL), "Accept-Language", "en"))
+			cache.Fetch(url, cachePath)
+			require.NoError(t, cache.Wait())
+			if meta, ok := cache.Files[url]; ok {
+				meta.FetchedAt = meta.FetchedAt.Add(-tc.age)
+				require.NoError(t, writeMeta(metaFile, cache.Files))
+			}
+
+			cache = NewCache(metaFile, Freshness(), HostHeader(hostOf(server.URL), "Accept-Language", tc.language))
+			got := cache.Fetch(url, cachePath).Wait()
+			require.NoError(t, cache.Wait())
+
+			assert.NoError(t, got.Err)
+			assert.Equal(t, "content", mustReadFile(t, cachePath))
+			assert.Equal(t, tc.requests, atomic.LoadInt32(&requests))
+			assert.Equal(t, tc.conditional, atomic.LoadInt32(&conditional))
+			_, stored := cache.Files[url]
+			assert.Equal(t, tc.stored, stored)
+		})
+	}
+}
+
+func TestCache_Fetch_staleWhileRevalidate(t *testing.T) {
+	var requests, conditional int32
+	server := freshnessServer("max-age=60, stale-while-revalidate=3600", &requests, &conditional)
+	defer server.Close()
+
+	dir := mustTempDir(t)
+	defer os.RemoveAll(dir)
+	cachePath := filepath.Join(dir, "a.txt")
+	url := server.URL + "/a.txt"
+
+	cache := NewCache(filepath.Join(dir, "meta.json"), StaleWhileRevalidate())
+	cache.Fetch(url, cachePath)
+	require.NoError(t, cache.Wait())
+	cache.Files[url].FetchedAt = now().Add(-10 * time.Minute)
+
+	got := cache.Fetch(url, cachePath).Wait()
+	assert.True(t, got.Hit)
+	assert.True(t, got.Stale)
+	require.NoError(t, cache.Wait())
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(&conditional), "revalidated in the background")
+	assert.WithinDuration(t, time.Now(), cache.Files[url].FetchedAt, time.Minute)
+}
+
+func TestCache_Fetch_staleIfError(t *testing.T) {
+	cases := map[string]struct {
+		age    time.Duration
+		status int
+
+		stale bool
+	}{
+		"server error": {
+			10 * time.Minute,
+			http.StatusServiceUnavailable,
+			true,
+		},
+		"outside window": {
+			3 * time.Hour,
+			http.StatusServiceUnavailable,
+			false,
+		},
+		"not found": {
+			10 * time.Minute,
+			http.StatusNotFound,
+			false,
+		},
+	}
+
+	for name, tc := range cases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			var failing int32
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if atomic.LoadInt32(&failing) == 1 {
+					w.WriteHeader(tc.status)
+					return
+				}
+				w.Header().Set("Cache-Control", "max-age=60, stale-if-error=3600")
+				_, _ = w.Write([]byte("content"))
+			}))
+			defer server.Close()
+
+			dir := mustTempDir(t)
+			defer os.RemoveAll(dir)
+			cachePath := filepath.Join(dir, "a.txt")
+			url := server.URL + "/a.txt"
+
+			cache := NewCache(filepath.Join(dir, "meta.json"), StaleIfError(), Retry(RetryPolicy{MaxAttempts: 1}))
+			cache.Fetch(url, cachePath)
+			require.NoError(t, cache.Wait())
+			cache.Files[url].FetchedAt = now().Add(-tc.age)
+			atomic.StoreInt32(&failing, 1)
+
+			got := cache.Fetch(url, cachePath).Wait()
+			err := cache.Wait()
+
+			assert.Equal(t, tc.stale, got.Stale)
+			if tc.stale {
+				assert.NoError(t, got.Err)
+				assert.NoError(t, err)
+			} else {
+				assert.Error(t, got.Err)
+				assert.Error(t, err)
+			}
+			assert.Equal(t, "content", mustReadFile(t, cachePath))
+		})
+	}
+}
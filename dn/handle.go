@@ -0,0 +1,52 @@
+package dn
+
+// Result is the outcome of a file requested from the cache.
+type Result struct {
+	URL  string
+	Path string
+	ETag string
+	// Bytes is the number of bytes transferred, 0 for a cache hit.
+	Bytes int64
+	// Hit is true when the cached copy was used, either directly or after the server confirmed it.
+	Hit bool
+	// Stale is true when a stale cached copy was used, see StaleWhileRevalidate and StaleIfError.
+	Stale bool
+	// Dir is the directory the file was extracted to, see Extract.
+	Dir string
+	// Retries is the number of times the download was retried, see Retry.
+	Retries int
+	Err     error
+}
+
+// Handle tracks a file requested from the cache. Its path is known right away, but the file may only be
+// opened once the handle is done.
+type Handle struct {
+	path   string
+	done   chan struct{}
+	result Result
+}
+
+func newHandle(path string) *Handle {
+	return &Handle{path: path, done: make(chan struct{})}
+}
+
+// Path returns the location of the file in the cache.
+func (h *Handle) Path() string {
+	return h.path
+}
+
+// Done returns a channel that is closed when the file is ready or failed.
+func (h *Handle) Done() <-chan struct{} {
+	return h.done
+}
+
+// Wait blocks until the handle is done and returns its result.
+func (h *Handle) Wait() Result {
+	<-h.done
+	return h.result
+}
+
+func (h *Handle) complete(result Result) {
+	h.result = result
+	close(h.done)
+}
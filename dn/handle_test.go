@@ -0,0 +1,83 @@
+package dn
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCache_Fetch_handle(t *testing.T) {
+	var requests int32
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		<-release
+		w.Header().Set("ETag", `"v1"`)
+		_, _ = w.Write([]byte("content"))
+	}))
+	defer server.Close()
+
+	dir := mustTempDir(t)
+	defer os.RemoveAll(dir)
+	cachePath := filepath.Join(dir, "a.txt")
+
+	cache := NewCache(filepath.Join(dir, "meta.json"))
+
+	var wg sync.WaitGroup
+	handles := make([]*Handle, 10)
+	for i := range handles {
+		i := i
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			handles[i] = cache.Fetch(server.URL, cachePath)
+		}()
+	}
+	wg.Wait()
+
+	first := handles[0]
+	select {
+	case <-first.Done():
+		t.Fatal("handle done before the download finished")
+	default:
+	}
+	close(release)
+
+	want := Result{URL: server.URL, Path: cachePath, ETag: `"v1"`, Bytes: 7}
+	for _, h := range handles {
+		assert.Equal(t, first, h, "concurrent fetches share one download")
+		assert.Equal(t, want, h.Wait())
+	}
+	assert.Equal(t, "content", mustReadFile(t, cachePath))
+	require.NoError(t, cache.Wait())
+	assert.Equal(t, int32(1), atomic.LoadInt32(&requests))
+
+	hit := cache.Fetch(server.URL, cachePath)
+	<-hit.Done()
+	assert.NotEqual(t, first, hit)
+	assert.Equal(t, Result{URL: server.URL, Path: cachePath, ETag: `"v1"`, Hit: true}, hit.Wait())
+	assert.Equal(t, int32(1), atomic.LoadInt32(&requests))
+}
+
+func TestCache_Fetch_handleError(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	defer server.Close()
+
+	dir := mustTempDir(t)
+	defer os.RemoveAll(dir)
+
+	cache := NewCache(filepath.Join(dir, "meta.json"))
+	result := cache.Fetch(server.URL, filepath.Join(dir, "a.txt")).Wait()
+
+	require.IsType(t, &DownloadError{}, result.Err)
+	failure := result.Err.(*DownloadError)
+	assert.Equal(t, http.StatusNotFound, failure.StatusCode())
+	assert.Error(t, cache.Wait())
+}
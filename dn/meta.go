@@ -0,0 +1,195 @@
+package dn
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// metaVersion is the schema version of the meta file. Version 1 files, written before the version was
+// recorded, hold the bare url to CacheMeta map.
+const metaVersion = 2
+
+type metaDocument struct {
+	Version int                   `json:"version"`
+	Files   map[string]*CacheMeta `json:"files"`
+}
+
+// decodeMeta reads a meta file of any supported version.
+func decodeMeta(content []byte) (map[string]*CacheMeta, error) {
+	files := make(map[string]*CacheMeta)
+	if len(bytes.TrimSpace(content)) == 0 {
+		return files, nil
+	}
+
+	var probe struct {
+		Version *int `json:"version"`
+	}
+	if err := json.Unmarshal(content, &probe); err != nil {
+		return nil, err
+	}
+
+	switch {
+	case probe.Version == nil:
+		if err := json.Unmarshal(content, &files); err != nil {
+			return nil, err
+		}
+	case *probe.Version <= metaVersion:
+		var doc metaDocument
+		if err := json.Unmarshal(content, &doc); err != nil {
+			return nil, err
+		}
+		if doc.Files != nil {
+			files = doc.Files
+		}
+	default:
+		return nil, fmt.Errorf("meta file version %d is newer than the supported version %d", *probe.Version, metaVersion)
+	}
+
+	for url, meta := range files {
+		if meta == nil {
+			delete(files, url)
+		}
+	}
+	return files, nil
+}
+
+func readMeta(metaFile string) (map[string]*CacheMeta, error) {
+	content, err := ioutil.ReadFile(metaFile) // #nosec
+	if os.IsNotExist(err) {
+		return make(map[string]*CacheMeta), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	files, err := decodeMeta(content)
+	if err != nil {
+		return nil, fmt.Errorf("read meta file %s: %v", metaFile, err)
+	}
+	return files, nil
+}
+
+// writeMeta replaces metaFile atomically, readers see either the old or the new content.
+func writeMeta(metaFile string, files map[string]*CacheMeta) error {
+	content, err := json.MarshalIndent(&metaDocument{Version: metaVersion, Files: files}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Dir(metaFile)
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return err
+	}
+	out, err := ioutil.TempFile(dir, filepath.Base(metaFile)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer shouldRemove(out.Name())
+
+	_, err = out.Write(content)
+	if err == nil {
+		err = out.Sync()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(out.Name(), 0644)
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(out.Name(), metaFile)
+}
+
+// OpenCache works like NewCache but fails when the meta file exists and can not be read.
+func OpenCache(metaFile string, options ...Option) (*Cache, error) {
+	c := newCache(metaFile, options...)
+	if err := c.loadMeta(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (cache *Cache) loadMeta() error {
+	if len(cache.metaFile) == 0 {
+		return nil
+	}
+
+	files, err := readMeta(cache.metaFile)
+	if err != nil {
+		return err
+	}
+	cache.Files = files
+	cache.markSyncedLocked()
+	return nil
+}
+
+// markSyncedLocked remembers the fetch time of every entry as it is in the meta file.
+func (cache *Cache) markSyncedLocked() {
+	cache.synced = make(map[string]time.Time, len(cache.Files))
+	for url, meta := range cache.Files {
+		cache.synced[url] = meta.FetchedAt
+	}
+}
+
+// forgetLocked removes url from Files, the entry is also dropped from the meta file on the next save even
+// when another process still has it.
+func (cache *Cache) forgetLocked(url string) {
+	delete(cache.Files, url)
+	cache.removed[url] = true
+}
+
+// saveMeta merges the entries saved by other processes sharing the meta file and writes the result. The
+// meta file is locked while doing so, the newest fetch of an url wins and an entry removed by another
+// process stays removed unless it was fetched again since.
+func (cache *Cache) saveMeta() error {
+	if len(cache.metaFile) == 0 {
+		return nil
+	}
+
+	unlock, err := lockFile(cache.metaFile + ".lock")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	saved, err := readMeta(cache.metaFile)
+	if err != nil {
+		log.Printf("dn: %v, the meta file is rewritten\n", err)
+		saved = nil
+	}
+
+	cache.mux.Lock()
+	defer cache.mux.Unlock()
+
+	if saved != nil {
+		for url, ours := range cache.Files {
+			fetched, synced := cache.synced[url]
+			if _, ok := saved[url]; !ok && synced && fetched.Equal(ours.FetchedAt) {
+				delete(cache.Files, url)
+			}
+		}
+	}
+	for url, theirs := range saved {
+		if cache.removed[url] {
+			continue
+		}
+		if ours, ok := cache.Files[url]; !ok || theirs.FetchedAt.After(ours.FetchedAt) {
+			cache.Files[url] = theirs
+		}
+	}
+	cache.removed = make(map[string]bool)
+
+	if err := writeMeta(cache.metaFile, cache.Files); err != nil {
+		return err
+	}
+	cache.markSyncedLocked()
+	return nil
+}
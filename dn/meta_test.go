@@ -0,0 +1,203 @@
+package dn
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDecodeMeta(t *testing.T) {
+	cases := map[string]struct {
+		content string
+
+		want map[string]*CacheMeta
+		ok   bool
+	}{
+		"empty": {
+			"",
+			map[string]*CacheMeta{},
+			true,
+		},
+		"version 1": {
+			`{"http://a": {"saved": "a.txt", "etag": "\"v1\""}}`,
+			map[string]*CacheMeta{"http://a": {Saved: "a.txt", ETag: `"v1"`}},
+			true,
+		},
+		"version 2": {
+			`{"version": 2, "files": {"http://a": {"saved": "a.txt", "md5": "abc"}}}`,
+			map[string]*CacheMeta{"http://a": {Saved: "a.txt", MD5: "abc"}},
+			true,
+		},
+		"version 2 without files": {
+			`{"version": 2}`,
+			map[string]*CacheMeta{},
+			true,
+		},
+		"null entry": {
+			`{"http://a": null}`,
+			map[string]*CacheMeta{},
+			true,
+		},
+		"newer version": {
+			`{"version": 99, "files": {}}`,
+			nil,
+			false,
+		},
+		"corrupted": {
+			`{"http://a": {"saved": `,
+			nil,
+			false,
+		},
+	}
+
+	for name, tc := range cases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			got, err := decodeMeta([]byte(tc.content))
+			if !tc.ok {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.want, got)
+		})
+	}
+}
+
+func TestWriteMeta(t *testing.T) {
+	dir := mustTempDir(t)
+	defer os.RemoveAll(dir)
+
+	metaFile := filepath.Join(dir, "meta", "meta.json")
+	files := map[string]*CacheMeta{"http://a": {Saved: "a.txt", MD5: "abc"}}
+	require.NoError(t, writeMeta(metaFile, files))
+
+	content, err := ioutil.ReadFile(metaFile)
+	require.NoError(t, err)
+	assert.Contains(t, string(content), `"version": 2`)
+
+	got, err := readMeta(metaFile)
+	require.NoError(t, err)
+	assert.Equal(t, files, got)
+
+	entries, err := ioutil.ReadDir(filepath.Dir(metaFile))
+	require.NoError(t, err)
+	assert.Len(t, entries, 1, "temp files are cleaned up")
+}
+
+func TestOpenCache(t *testing.T) {
+	dir := mustTempDir(t)
+	defer os.RemoveAll(dir)
+
+	metaFile := filepath.Join(dir, "meta.json")
+	cache, err := OpenCache(metaFile)
+	require.NoError(t, err)
+	assert.Empty(t, cache.Files)
+
+	require.NoError(t, ioutil.WriteFile(metaFile, []byte("{broken"), 0644))
+	_, err = OpenCache(metaFile)
+	assert.Error(t, err)
+
+	cache = NewCache(metaFile)
+	assert.Empty(t, cache.Files)
+	assert.NoError(t, cache.Wait(), "a broken meta file is replaced")
+
+	_, err = OpenCache(metaFile)
+	assert.NoError(t, err)
+}
+
+func TestCache_saveMeta_merge(t *testing.T) {
+	dir := mustTempDir(t)
+	defer os.RemoveAll(dir)
+
+	metaFile := filepath.Join(dir, "meta.json")
+	old := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	recent := old.Add(time.Hour)
+	require.NoError(t, writeMeta(metaFile, map[string]*CacheMeta{
+		"http://shared":  {Saved: "shared", ETag: "old", FetchedAt: old},
+		"http://removed": {Saved: "removed", FetchedAt: old},
+	}))
+
+	first := NewCache(metaFile)
+	second := NewCache(metaFile)
+
+	first.Files["http://first"] = &CacheMeta{Saved: "first", FetchedAt: recent}
+	first.Files["http://shared"] = &CacheMeta{Saved: "shared", ETag: "first", FetchedAt: recent}
+	first.mux.Lock()
+	first.forgetLocked("http://removed")
+	first.mux.Unlock()
+	require.NoError(t, first.Wait())
+
+	second.Files["http://second"] = &CacheMeta{Saved: "second", FetchedAt: recent}
+	require.NoError(t, second.Wait())
+
+	got, err := readMeta(metaFile)
+	require.NoError(t, err)
+	assert.Len(t, got, 3)
+	assert.Contains(t, got, "http://first")
+	assert.Contains(t, got, "http://second")
+	assert.Equal(t, "first", got["http://shared"].ETag, "the newest fetch wins")
+	assert.NotContains(t, got, "http://removed")
+}
+
+func TestCache_saveMeta_concurrent(t *testing.T) {
+	dir := mustTempDir(t)
+	defer os.RemoveAll(dir)
+
+	metaFile := filepath.Join(dir, "meta.json")
+	const caches = 8
+
+	var wg sync.WaitGroup
+	for i := 0; i < caches; i++ {
+		i := i
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			cache := NewCache(metaFile)
+			url := "http://example.com/" + string(rune('a'+i))
+			cache.Files[url] = &CacheMeta{Saved: url, FetchedAt: now()}
+			assert.NoError(t, cache.Wait())
+		}()
+	}
+	wg.Wait()
+
+	got, err := readMeta(metaFile)
+	require.NoError(t, err)
+	assert.Len(t, got, caches)
+}
+
+func TestLockFile(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("meta file locking is not supported")
+	}
+
+	dir := mustTempDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "meta.json.lock")
+
+	unlock, err := lockFile(path)
+	require.NoError(t, err)
+
+	locked := make(chan struct{})
+	go func() {
+		unlockSecond, err := lockFile(path)
+		assert.NoError(t, err)
+		close(locked)
+		unlockSecond()
+	}()
+
+	select {
+	case <-locked:
+		t.Fatal("second lock acquired while the first is held")
+	case <-time.After(50 * time.Millisecond):
+	}
+	unlock()
+	<-locked
+}
@@ -0,0 +1,140 @@
+package dn
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// Resource is a file published on several mirrors, it is cached under its ID instead of a url.
+type Resource struct {
+	ID   string
+	URLs []string
+	// Race downloads from the first Race mirrors at the same time and keeps the first to succeed, the other
+	// mirrors are tried in order if they all fail. Below 2 every mirror is tried in order.
+	Race int
+	// Digest verifies the file like FetchVerified when it is not nil.
+	Digest *Digest
+}
+
+// FetchResource works like FetchContext for a resource published on several mirrors. The download only fails
+// when every mirror failed, its Err is then a *MirrorError. The mirror that served the file is recorded in
+// the Mirror field of the meta.
+func (cache *Cache) FetchResource(ctx context.Context, resource Resource, cachePath string) *Handle {
+	return cache.fetch(&task{
+		ctx:     ctx,
+		url:     resource.ID,
+		path:    cachePath,
+		digest:  resource.Digest,
+		mirrors: append([]string{}, resource.URLs...),
+		race:    resource.Race,
+	})
+}
+
+// forMirror returns the task downloading t from mirror to cachePath, the validators of t only apply to the
+// mirror that served the cached copy.
+func (t *task) forMirror(mirror string, cachePath string) *task {
+	mt := *t
+	mt.url, mt.path = mirror, cachePath
+	mt.mirrors, mt.handle = nil, nil
+	if t.validators != nil && t.validators.Mirror != mirror {
+		mt.validators = nil
+	}
+	return &mt
+}
+
+// downloadMirrors downloads t from the first of its mirrors that succeeds.
+func (cache *Cache) downloadMirrors(t *task) (*download, error) {
+	var failures []*DownloadError
+	next := 0
+	if t.race > 1 {
+		next = t.race
+		if next > len(t.mirrors) {
+			next = len(t.mirrors)
+		}
+		result, raced := cache.raceMirrors(t, t.mirrors[:next])
+		if result != nil {
+			return result, nil
+		}
+		failures = append(failures, raced...)
+	}
+
+	for _, mirror := range t.mirrors[next:] {
+		if t.ctx.Err() != nil {
+			break
+		}
+		result, err := cache.downloadWithRetry(t.forMirror(mirror, t.path))
+		if err == nil {
+			result.mirror = mirror
+			return result, nil
+		}
+		failures = append(failures, downloadErrorOf(mirror, t.path, err))
+	}
+
+	failure := &DownloadError{URL: t.url, Path: t.path, Cause: CauseRequest, Err: errors.New("no mirror")}
+	switch {
+	case t.ctx.Err() != nil:
+		failure.Cause, failure.Err = CauseCanceled, t.ctx.Err()
+	case len(failures) > 0:
+		failure.Cause, failure.Err = failures[len(failures)-1].Cause, &MirrorError{Failures: failures}
+	}
+	for _, f := range failures {
+		failure.Retries += f.Retries
+	}
+	return nil, failure
+}
+
+// raceMirrors downloads t from all mirrors at the same time, each to its own file, and keeps the first to
+// succeed. It returns the failures in the order of mirrors when none succeeded.
+func (cache *Cache) raceMirrors(t *task, mirrors []string) (*download, []*DownloadError) {
+	ctx, cancel := context.WithCancel(t.ctx)
+	defer cancel()
+
+	type outcome struct {
+		i      int
+		result *download
+		err    error
+	}
+	outcomes := make(chan outcome, len(mirrors))
+	paths := make([]string, len(mirrors))
+	for i, mirror := range mirrors {
+		paths[i] = fmt.Sprintf("%s.mirror%d", t.path, i)
+		mt := t.forMirror(mirror, paths[i])
+		mt.ctx = ctx
+		go func(i int, mt *task) {
+			result, err := cache.downloadWithRetry(mt)
+			outcomes <- outcome{i, result, err}
+		}(i, mt)
+	}
+
+	winner := -1
+	var result *download
+	failures := make([]*DownloadError, len(mirrors))
+	for range mirrors {
+		o := <-outcomes
+		if o.err == nil && winner < 0 {
+			winner, result = o.i, o.result
+			cancel()
+		} else if o.err != nil {
+			failures[o.i] = downloadErrorOf(mirrors[o.i], paths[o.i], o.err)
+		}
+	}
+
+	var err error
+	if winner >= 0 && !result.notModified {
+		err = move(paths[winner], t.path)
+	}
+	for i, mirror := range mirrors {
+		shouldRemove(paths[i])
+		loadPartial(mirror, paths[i]).discard()
+	}
+
+	if winner >= 0 && err == nil {
+		result.mirror = mirrors[winner]
+		return result, nil
+	}
+	if winner >= 0 {
+		return nil, []*DownloadError{{URL: mirrors[winner], Path: t.path, Cause: CauseDisk, Err: err}}
+	}
+	return nil, failures
+}
@@ -0,0 +1,186 @@
+package dn
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func mirrorServer(content string, requests *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(requests, 1)
+		w.Header().Set("ETag", `"`+content+`"`)
+		if r.Header.Get("If-None-Match") == `"`+content+`"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		_, _ = w.Write([]byte(content))
+	}))
+}
+
+func TestCache_FetchResource(t *testing.T) {
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer broken.Close()
+	stalled := stalledServer()
+	defer stalled.Close()
+	var firstRequests, secondRequests int32
+	first := mirrorServer("first", &firstRequests)
+	defer first.Close()
+	second := mirrorServer("second", &secondRequests)
+	defer second.Close()
+
+	cases := map[string]struct {
+		urls []string
+		race int
+
+		want   string
+		mirror string
+		cause  Cause
+	}{
+		"first": {
+			[]string{first.URL, second.URL},
+			0,
+			"first",
+			first.URL,
+			"",
+		},
+		"fallback": {
+			[]string{broken.URL, second.URL},
+			0,
+			"second",
+			second.URL,
+			"",
+		},
+		"race": {
+			[]string{stalled.URL, second.URL, first.URL},
+			2,
+			"second",
+			second.URL,
+			"",
+		},
+		"race fallback": {
+			[]string{broken.URL, broken.URL + "/other", first.URL},
+			2,
+			"first",
+			first.URL,
+			"",
+		},
+		"all failed": {
+			[]string{broken.URL, broken.URL + "/other"},
+			0,
+			"",
+			"",
+			CauseStatus,
+		},
+		"no mirror": {
+			nil,
+			0,
+			"",
+			"",
+			CauseRequest,
+		},
+	}
+
+	for name, tc := range cases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			dir := mustTempDir(t)
+			defer os.RemoveAll(dir)
+
+			cache := NewCache(filepath.Join(dir, "meta.json"), Retry(RetryPolicy{MaxAttempts: 1}))
+			cachePath := filepath.Join(dir, "lib.txt")
+			got := cache.FetchResource(context.Background(), Resource{ID: "lib", URLs: tc.urls, Race: tc.race}, cachePath).Wait()
+			err := cache.Wait()
+
+			if len(tc.cause) > 0 {
+				require.IsType(t, &DownloadError{}, got.Err)
+				failure := got.Err.(*DownloadError)
+				assert.Equal(t, tc.cause, failure.Cause)
+				assert.Equal(t, "lib", failure.URL)
+				if len(tc.urls) > 0 {
+					require.IsType(t, &MirrorError{}, failure.Err)
+					assert.Len(t, failure.Err.(*MirrorError).Failures, len(tc.urls))
+				}
+				assert.Error(t, err)
+				assert.Empty(t, cache.Files)
+				return
+			}
+			assert.NoError(t, got.Err)
+			assert.NoError(t, err)
+			assert.Equal(t, "lib", got.URL)
+			assert.Equal(t, tc.want, mustReadFile(t, cachePath))
+			assert.Equal(t, tc.mirror, cache.Files["lib"].Mirror)
+			assert.Len(t, cache.Files, 1)
+
+			leftovers, err := filepath.Glob(cachePath + ".*")
+			require.NoError(t, err)
+			assert.Empty(t, leftovers)
+		})
+	}
+}
+
+func TestCache_FetchResource_revalidate(t *testing.T) {
+	var firstRequests, secondRequests int32
+	first := mirrorServer("first", &firstRequests)
+	defer first.Close()
+	second := mirrorServer("second", &secondRequests)
+	defer second.Close()
+
+	dir := mustTempDir(t)
+	defer os.RemoveAll(dir)
+	metaFile := filepath.Join(dir, "meta.json")
+	cachePath := filepath.Join(dir, "lib.txt")
+
+	cache := NewCache(metaFile)
+	cache.FetchResource(context.Background(), Resource{ID: "lib", URLs: []string{second.URL}}, cachePath)
+	require.NoError(t, cache.Wait())
+
+	cache = NewCache(metaFile, Revalidate())
+	got := cache.FetchResource(context.Background(), Resource{ID: "lib", URLs: []string{second.URL, first.URL}}, cachePath).Wait()
+	require.NoError(t, cache.Wait())
+
+	assert.True(t, got.Hit)
+	assert.Equal(t, "second", mustReadFile(t, cachePath))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&secondRequests))
+	assert.Equal(t, int32(0), atomic.LoadInt32(&firstRequests))
+}
+
+func TestCache_Verify_resource(t *testing.T) {
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer broken.Close()
+	var requests int32
+	mirror := mirrorServer("content", &requests)
+	defer mirror.Close()
+
+	dir := mustTempDir(t)
+	defer os.RemoveAll(dir)
+	metaFile := filepath.Join(dir, "meta.json")
+	cachePath := filepath.Join(dir, "resource")
+	resource := Resource{ID: "my-resource", URLs: []string{broken.URL, mirror.URL}}
+
+	cache := NewCache(metaFile)
+	require.NoError(t, cache.FetchResource(context.Background(), resource, cachePath).Wait().Err)
+	require.NoError(t, cache.Wait())
+	assert.Equal(t, resource.URLs, NewCache(metaFile).Files["my-resource"].Mirrors)
+
+	require.NoError(t, ioutil.WriteFile(cachePath, []byte("corrupted"), 0644))
+	cache = NewCache(metaFile)
+	assert.Equal(t, []string{"my-resource"}, cache.Verify(Redownload))
+	require.NoError(t, cache.Wait())
+
+	assert.Equal(t, "content", mustReadFile(t, cachePath))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&requests))
+	assert.Equal(t, mirror.URL, NewCache(metaFile).Files["my-resource"].Mirror)
+}
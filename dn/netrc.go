@@ -0,0 +1,140 @@
+package dn
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+type netrcEntry struct {
+	login    string
+	password string
+}
+
+// Netrc holds the credentials of a netrc file, it authenticates requests with the login and password of the
+// machine matching their host, use Auth("", netrc) to enable it for every host.
+type Netrc struct {
+	machines map[string]netrcEntry
+	fallback *netrcEntry
+}
+
+// DefaultNetrcPath returns the file named by $NETRC, or ~/.netrc.
+func DefaultNetrcPath() string {
+	if path := os.Getenv("NETRC"); len(path) > 0 {
+		return path
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".netrc")
+}
+
+// LoadNetrc reads the netrc file at path.
+func LoadNetrc(path string) (*Netrc, error) {
+	file, err := os.Open(path) // #nosec
+	if err != nil {
+		return nil, err
+	}
+	defer shouldClose(file)
+
+	return ParseNetrc(file)
+}
+
+// ParseNetrc parses the machine, default, login and password tokens of a netrc file, macros are skipped.
+func ParseNetrc(r io.Reader) (*Netrc, error) {
+	netrc := &Netrc{machines: make(map[string]netrcEntry)}
+
+	var entry *netrcEntry
+	var machine string
+	flush := func() {
+		if entry == nil {
+			return
+		}
+		if len(machine) > 0 {
+			netrc.machines[machine] = *entry
+		} else {
+			netrc.fallback = entry
+		}
+		entry = nil
+	}
+
+	scanner := bufio.NewScanner(r)
+	inMacro := false
+	for scanner.Scan() {
+		line := scanner.Text()
+		if inMacro {
+			inMacro = len(strings.TrimSpace(line)) > 0
+			continue
+		}
+
+		tokens := strings.Fields(line)
+		for i := 0; i < len(tokens); i++ {
+			token := tokens[i]
+			if strings.HasPrefix(token, "#") {
+				break
+			}
+
+			switch token {
+			case "macdef":
+				inMacro = true
+				i = len(tokens)
+				continue
+			case "default":
+				flush()
+				machine = ""
+				entry = &netrcEntry{}
+				continue
+			}
+
+			if i+1 >= len(tokens) {
+				return nil, fmt.Errorf("netrc: missing value of %q", token)
+			}
+			value := tokens[i+1]
+			i++
+
+			switch token {
+			case "machine":
+				flush()
+				machine = value
+				entry = &netrcEntry{}
+			case "login":
+				if entry != nil {
+					entry.login = value
+				}
+			case "password":
+				if entry != nil {
+					entry.password = value
+				}
+			case "account", "port":
+			default:
+				return nil, fmt.Errorf("netrc: unknown token %q", token)
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	flush()
+
+	return netrc, nil
+}
+
+// Authenticate sets the basic auth credentials of the machine matching the host of req, or of the default
+// entry. Requests are left untouched when nothing matches.
+func (netrc *Netrc) Authenticate(req *http.Request) error {
+	for _, host := range hostKeys(req.URL) {
+		if entry, ok := netrc.machines[host]; ok {
+			req.SetBasicAuth(entry.login, entry.password)
+			return nil
+		}
+	}
+	if netrc.fallback != nil {
+		req.SetBasicAuth(netrc.fallback.login, netrc.fallback.password)
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+package dn
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testNetrc = `
+# artifact servers
+machine artifacts.example.com login ci password s3cret
+machine mirror.example.com:8443
+	login mirror
+	password pw
+
+macdef init
+cd /pub
+machine evil.example.com login macro password macro
+
+default login anonymous password guest
+`
+
+func TestParseNetrc(t *testing.T) {
+	netrc, err := ParseNetrc(strings.NewReader(testNetrc))
+	require.NoError(t, err)
+
+	cases := map[string]struct {
+		url string
+
+		user     string
+		password string
+		ok       bool
+	}{
+		"machine":   {"https://artifacts.example.com/a.tgz", "ci", "s3cret", true},
+		"with port": {"https://mirror.example.com:8443/a.tgz", "mirror", "pw", true},
+		"port only matches host:port": {
+			"https://mirror.example.com/a.tgz", "anonymous", "guest", true,
+		},
+		"macro is skipped": {"https://evil.example.com/a.tgz", "anonymous", "guest", true},
+		"default":          {"https://other.example.com/a.tgz", "anonymous", "guest", true},
+	}
+
+	for name, tc := range cases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, tc.url, nil)
+			require.NoError(t, err)
+			require.NoError(t, netrc.Authenticate(req))
+
+			user, password, ok := req.BasicAuth()
+			assert.Equal(t, tc.ok, ok)
+			assert.Equal(t, tc.user, user)
+			assert.Equal(t, tc.password, password)
+		})
+	}
+}
+
+func TestParseNetrc_noDefault(t *testing.T) {
+	netrc, err := ParseNetrc(strings.NewReader("machine a.example.com login a password b"))
+	require.NoError(t, err)
+
+	req, err := http.NewRequest(http.MethodGet, "https://b.example.com", nil)
+	require.NoError(t, err)
+	require.NoError(t, netrc.Authenticate(req))
+
+	_, _, ok := req.BasicAuth()
+	assert.False(t, ok)
+}
+
+func TestParseNetrc_error(t *testing.T) {
+	cases := map[string]string{
+		"missing value": "machine a.example.com login",
+		"unknown token": "machine a.example.com user a",
+	}
+
+	for name, content := range cases {
+		content := content
+		t.Run(name, func(t *testing.T) {
+			_, err := ParseNetrc(strings.NewReader(content))
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestLoadNetrc(t *testing.T) {
+	dir := mustTempDir(t)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, ".netrc")
+	require.NoError(t, ioutil.WriteFile(path, []byte(testNetrc), 0600))
+
+	netrc, err := LoadNetrc(path)
+	require.NoError(t, err)
+	assert.Len(t, netrc.machines, 2)
+
+	_, err = LoadNetrc(filepath.Join(dir, "missing"))
+	assert.Error(t, err)
+}
+
+func TestDefaultNetrcPath(t *testing.T) {
+	defer os.Setenv("NETRC", os.Getenv("NETRC"))
+
+	require.NoError(t, os.Setenv("NETRC", "/etc/netrc"))
+	assert.Equal(t, "/etc/netrc", DefaultNetrcPath())
+
+	require.NoError(t, os.Unsetenv("NETRC"))
+	assert.Equal(t, ".netrc", filepath.Base(DefaultNetrcPath()))
+}
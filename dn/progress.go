@@ -0,0 +1,133 @@
+package dn
+
+import (
+	"io"
+	"time"
+)
+
+// Progress reports how far a download got.
+type Progress struct {
+	URL  string
+	Path string
+	// Bytes is the size of the file so far, a resumed download starts at the size of its partial file.
+	Bytes int64
+	// Total is the size of the complete file, 0 when the server did not send it.
+	Total int64
+	// Rate is the transfer rate of the download in bytes per second.
+	Rate float64
+	// ETA is the estimated time left, 0 when Total or Rate is unknown.
+	ETA time.Duration
+	// Done is set on the last report of a download that completed.
+	Done bool
+}
+
+// OnProgress calls report with the progress of every download at most once per interval and once more when
+// it completes. report is called from the download goroutines, concurrently for downloads running in parallel.
+func OnProgress(interval time.Duration, report func(Progress)) Option {
+	return func(cache *Cache) {
+		cache.progressInterval = interval
+		cache.progress = report
+	}
+}
+
+// progressReader counts the bytes read from the body of a download and reports them.
+type progressReader struct {
+	body     io.Reader
+	report   func(Progress)
+	interval time.Duration
+	progress Progress
+	offset   int64
+	started  time.Time
+	reported time.Time
+}
+
+// trackProgress wraps the body of the download of t, offset is the size of the partial file it continues and
+// total the size of the complete file, 0 when unknown.
+func (cache *Cache) trackProgress(t *task, body io.Reader, offset int64, total int64) io.Reader {
+	if cache.progress == nil {
+		return body
+	}
+	if total < 0 {
+		total = 0
+	}
+	started := time.Now()
+	return &progressReader{
+		body:     body,
+		report:   cache.progress,
+		interval: cache.progressInterval,
+		progress: Progress{URL: t.url, Path: t.path, Bytes: offset, Total: total},
+		offset:   offset,
+		started:  started,
+		reported: started,
+	}
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.body.Read(b)
+	p.progress.Bytes += int64(n)
+
+	now := time.Now()
+	if err == io.EOF {
+		p.progress.Done = true
+		p.emit(now)
+	} else if now.Sub(p.reported) >= p.interval {
+		p.emit(now)
+	}
+	return n, err
+}
+
+func (p *progressReader) emit(now time.Time) {
+	p.reported = now
+	elapsed := now.Sub(p.started).Seconds()
+	if elapsed > 0 {
+		p.progress.Rate = float64(p.progress.Bytes-p.offset) / elapsed
+	}
+	p.progress.ETA = 0
+	if p.progress.Total > p.progress.Bytes && p.progress.Rate > 0 {
+		p.progress.ETA = time.Duration(float64(p.progress.Total-p.progress.Bytes) / p.progress.Rate * float64(time.Second))
+	}
+	p.report(p.progress)
+}
+
+// Stats counts what the cache did since it was created.
+type Stats struct {
+	// Hits counts the files used from the cache, including the ones the server confirmed.
+	Hits int
+	// Misses counts the files downloaded.
+	Misses int
+	// Revalidations counts the cached files checked with the server.
+	Revalidations int
+	// Bytes is the number of bytes downloaded.
+	Bytes int64
+	// Failures counts the failed downloads.
+	Failures int
+}
+
+// Stats returns the statistics of the cache.
+func (cache *Cache) Stats() Stats {
+	cache.mux.Lock()
+	defer cache.mux.Unlock()
+	return cache.stats
+}
+
+// count adds a resolved result to the statistics.
+func (cache *Cache) count(result Result) {
+	cache.mux.Lock()
+	defer cache.mux.Unlock()
+
+	switch {
+	case result.Err != nil:
+		cache.stats.Failures++
+	case result.Hit:
+		cache.stats.Hits++
+	default:
+		cache.stats.Misses++
+	}
+	cache.stats.Bytes += result.Bytes
+}
+
+func (cache *Cache) countRevalidation() {
+	cache.mux.Lock()
+	defer cache.mux.Unlock()
+	cache.stats.Revalidations++
+}
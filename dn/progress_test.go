@@ -0,0 +1,100 @@
+package dn
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCache_OnProgress(t *testing.T) {
+	content := strings.Repeat("x", 64*1024)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "a.txt", time.Time{}, strings.NewReader(content))
+	}))
+	defer server.Close()
+
+	dir := mustTempDir(t)
+	defer os.RemoveAll(dir)
+
+	var mux sync.Mutex
+	var reports []Progress
+	cache := NewCache(filepath.Join(dir, "meta.json"), OnProgress(0, func(p Progress) {
+		mux.Lock()
+		defer mux.Unlock()
+		reports = append(reports, p)
+	}))
+	cachePath := filepath.Join(dir, "a.txt")
+	cache.StartDownload(server.URL, cachePath)
+	require.NoError(t, cache.Wait())
+
+	require.NotEmpty(t, reports)
+	last := reports[len(reports)-1]
+	assert.True(t, last.Done)
+	assert.Equal(t, server.URL, last.URL)
+	assert.Equal(t, cachePath, last.Path)
+	assert.Equal(t, int64(len(content)), last.Bytes)
+	assert.Equal(t, int64(len(content)), last.Total)
+	assert.Equal(t, time.Duration(0), last.ETA)
+	for i, p := range reports {
+		assert.Equal(t, int64(len(content)), p.Total)
+		assert.Equal(t, i == len(reports)-1, p.Done)
+		if i > 0 {
+			assert.True(t, p.Bytes >= reports[i-1].Bytes)
+		}
+	}
+}
+
+func TestProgressReader_emit(t *testing.T) {
+	var got Progress
+	started := time.Now()
+	p := &progressReader{
+		report:   func(progress Progress) { got = progress },
+		progress: Progress{Bytes: 300, Total: 1000},
+		offset:   100,
+		started:  started,
+	}
+	p.emit(started.Add(2 * time.Second))
+
+	assert.Equal(t, 100.0, got.Rate)
+	assert.Equal(t, 7*time.Second, got.ETA)
+}
+
+func TestCache_Stats(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		_, _ = w.Write([]byte("content"))
+	}))
+	defer server.Close()
+
+	dir := mustTempDir(t)
+	defer os.RemoveAll(dir)
+	metaFile := filepath.Join(dir, "meta.json")
+
+	cache := NewCache(metaFile)
+	cache.Fetch(server.URL+"/a", filepath.Join(dir, "a.txt")).Wait()
+	cache.Fetch(server.URL+"/a", filepath.Join(dir, "a.txt")).Wait()
+	cache.Fetch(server.URL+"/missing", filepath.Join(dir, "missing.txt")).Wait()
+	assert.Error(t, cache.Wait())
+	assert.Equal(t, Stats{Hits: 1, Misses: 1, Bytes: 7, Failures: 1}, cache.Stats())
+
+	cache = NewCache(metaFile, Revalidate())
+	cache.Fetch(server.URL+"/a", filepath.Join(dir, "a.txt")).Wait()
+	assert.NoError(t, cache.Wait())
+	assert.Equal(t, Stats{Hits: 1, Revalidations: 1}, cache.Stats())
+}
@@ -0,0 +1,142 @@
+package dn
+
+import (
+	"log"
+	"os"
+	"sort"
+	"time"
+)
+
+// PrunePolicy tells Prune which cache entries to remove, a zero limit is not enforced.
+type PrunePolicy struct {
+	// MaxAge removes the entries fetched longer ago than MaxAge.
+	MaxAge time.Duration
+	// MaxSize removes the least recently used entries until the cached files take at most MaxSize bytes.
+	MaxSize int64
+	// MaxEntries removes the least recently used entries until at most MaxEntries are left.
+	MaxEntries int
+	// DryRun only reports what would be removed.
+	DryRun bool
+}
+
+// Reasons reported in a Pruned entry.
+const (
+	PruneMissing = "missing"
+	PruneAge     = "age"
+	PruneSize    = "size"
+	PruneEntries = "entries"
+)
+
+// Pruned is an entry removed by Prune.
+type Pruned struct {
+	URL    string
+	Path   string
+	Size   int64
+	Reason string
+}
+
+type pruneCandidate struct {
+	url      string
+	path     string
+	size     int64
+	fetched  time.Time
+	accessed time.Time
+}
+
+func (cache *Cache) pruneCandidates() ([]*pruneCandidate, []Pruned) {
+	cache.mux.Lock()
+	defer cache.mux.Unlock()
+
+	var candidates []*pruneCandidate
+	var missing []Pruned
+	for url, meta := range cache.Files {
+		info, err := os.Stat(meta.Saved)
+		if err != nil {
+			missing = append(missing, Pruned{URL: url, Path: meta.Saved, Reason: PruneMissing})
+			continue
+		}
+
+		c := &pruneCandidate{url: url, path: meta.Saved, size: info.Size(), fetched: meta.FetchedAt}
+		if c.fetched.IsZero() {
+			c.fetched = info.ModTime()
+		}
+		c.accessed = meta.AccessedAt
+		if c.accessed.IsZero() {
+			c.accessed = c.fetched
+		}
+		candidates = append(candidates, c)
+	}
+
+	// least recently used first
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].accessed.Equal(candidates[j].accessed) {
+			return candidates[i].url < candidates[j].url
+		}
+		return candidates[i].accessed.Before(candidates[j].accessed)
+	})
+	sort.Slice(missing, func(i, j int) bool {
+		return missing[i].URL < missing[j].URL
+	})
+	return candidates, missing
+}
+
+// Prune removes the cached files, their extracted trees and meta entries selected by policy and saves the
+// meta file, entries whose file is missing are always removed. It returns the removed entries, or the entries
+// that would be removed when policy.DryRun is set. Prune should not be called while downloads are running.
+func (cache *Cache) Prune(policy PrunePolicy) []Pruned {
+	candidates, pruned := cache.pruneCandidates()
+
+	var total int64
+	for _, c := range candidates {
+		total += c.size
+	}
+
+	now := time.Now()
+	var kept []*pruneCandidate
+	for _, c := range candidates {
+		if policy.MaxAge > 0 && now.Sub(c.fetched) > policy.MaxAge {
+			total -= c.size
+			pruned = append(pruned, Pruned{URL: c.url, Path: c.path, Size: c.size, Reason: PruneAge})
+			continue
+		}
+		kept = append(kept, c)
+	}
+
+	count := len(kept)
+	for _, c := range kept {
+		reason := ""
+		switch {
+		case policy.MaxSize > 0 && total > policy.MaxSize:
+			reason = PruneSize
+		case policy.MaxEntries > 0 && count > policy.MaxEntries:
+			reason = PruneEntries
+		default:
+			continue
+		}
+
+		total -= c.size
+		count--
+		pruned = append(pruned, Pruned{URL: c.url, Path: c.path, Size: c.size, Reason: reason})
+	}
+
+	if policy.DryRun || len(pruned) == 0 {
+		return pruned
+	}
+
+	cache.mux.Lock()
+	for _, p := range pruned {
+		shouldRemove(p.Path)
+		if meta, ok := cache.Files[p.URL]; ok && meta.Extracted != nil {
+			if err := os.RemoveAll(meta.Extracted.Dir); err != nil {
+				log.Println(err)
+			}
+		}
+		cache.forgetLocked(p.URL)
+	}
+	cache.mux.Unlock()
+	if err := cache.saveMeta(); err != nil {
+		log.Println(err)
+	}
+
+	return pruned
+}
@@ -0,0 +1,138 @@
+package dn
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/BakerHub/trivial/fs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type pruneEntry struct {
+	name     string
+	size     int
+	fetched  time.Duration
+	accessed time.Duration
+}
+
+func newPruneCache(t *testing.T, dir string, entries []pruneEntry) *Cache {
+	cache := NewCache(filepath.Join(dir, "meta.json"))
+	now := time.Now()
+	for _, e := range entries {
+		path := filepath.Join(dir, e.name)
+		require.NoError(t, ioutil.WriteFile(path, []byte(strings.Repeat("x", e.size)), 0644))
+		cache.Files["http://example.com/"+e.name] = &CacheMeta{
+			Saved:      path,
+			Size:       int64(e.size),
+			FetchedAt:  now.Add(-e.fetched),
+			AccessedAt: now.Add(-e.accessed),
+		}
+	}
+	return cache
+}
+
+func TestCache_Prune(t *testing.T) {
+	entries := []pruneEntry{
+		{"old", 10, 48 * time.Hour, time.Minute},
+		{"lru", 20, time.Hour, 3 * time.Hour},
+		{"mru", 30, time.Hour, time.Minute / 2},
+		{"mid", 40, time.Hour, 2 * time.Hour},
+	}
+
+	cases := map[string]struct {
+		policy PrunePolicy
+
+		want []Pruned
+	}{
+		"nothing": {
+			PrunePolicy{},
+			nil,
+		},
+		"max age": {
+			PrunePolicy{MaxAge: 24 * time.Hour},
+			[]Pruned{{URL: "http://example.com/old", Size: 10, Reason: PruneAge}},
+		},
+		"max size": {
+			PrunePolicy{MaxSize: 50},
+			[]Pruned{
+				{URL: "http://example.com/lru", Size: 20, Reason: PruneSize},
+				{URL: "http://example.com/mid", Size: 40, Reason: PruneSize},
+			},
+		},
+		"max entries": {
+			PrunePolicy{MaxEntries: 3},
+			[]Pruned{{URL: "http://example.com/lru", Size: 20, Reason: PruneEntries}},
+		},
+		"combined": {
+			PrunePolicy{MaxAge: 24 * time.Hour, MaxEntries: 2},
+			[]Pruned{
+				{URL: "http://example.com/lru", Size: 20, Reason: PruneEntries},
+				{URL: "http://example.com/old", Size: 10, Reason: PruneAge},
+			},
+		},
+	}
+
+	for name, tc := range cases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			for _, dryRun := range []bool{true, false} {
+				dir := mustTempDir(t)
+				defer os.RemoveAll(dir)
+
+				cache := newPruneCache(t, dir, entries)
+				policy := tc.policy
+				policy.DryRun = dryRun
+				got := cache.Prune(policy)
+
+				for i := range got {
+					got[i].Path = ""
+				}
+				assert.ElementsMatch(t, tc.want, got)
+
+				for _, p := range tc.want {
+					path := filepath.Join(dir, strings.TrimPrefix(p.URL, "http://example.com/"))
+					assert.Equal(t, dryRun, fs.Exists(path))
+					_, ok := cache.Files[p.URL]
+					assert.Equal(t, dryRun, ok)
+				}
+				remaining := len(entries)
+				if !dryRun {
+					remaining -= len(tc.want)
+				}
+				assert.Len(t, cache.Files, remaining)
+			}
+		})
+	}
+}
+
+func TestCache_Prune_missing(t *testing.T) {
+	dir := mustTempDir(t)
+	defer os.RemoveAll(dir)
+
+	cache := newPruneCache(t, dir, []pruneEntry{{"a", 1, 0, 0}})
+	cache.Files["http://example.com/gone"] = &CacheMeta{Saved: filepath.Join(dir, "gone")}
+
+	got := cache.Prune(PrunePolicy{})
+	assert.Equal(t, []Pruned{{URL: "http://example.com/gone", Path: filepath.Join(dir, "gone"), Reason: PruneMissing}}, got)
+
+	reloaded := NewCache(filepath.Join(dir, "meta.json"))
+	assert.Len(t, reloaded.Files, 1)
+	assert.Contains(t, reloaded.Files, "http://example.com/a")
+}
+
+func TestCache_Check_accessTime(t *testing.T) {
+	dir := mustTempDir(t)
+	defer os.RemoveAll(dir)
+
+	cache := newPruneCache(t, dir, []pruneEntry{{"a", 1, time.Hour, time.Hour}})
+	before := cache.Files["http://example.com/a"].AccessedAt
+
+	ok, _ := cache.Check("http://example.com/a", filepath.Join(dir, "a"))
+	assert.True(t, ok)
+	assert.True(t, cache.Files["http://example.com/a"].AccessedAt.After(before))
+}
@@ -0,0 +1,126 @@
+package dn
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Resume keeps interrupted downloads as <cachePath>.part next to the cache path, later attempts continue
+// them with a Range request as long as the server still serves the same version.
+func Resume() Option {
+	return func(cache *Cache) {
+		cache.resume = true
+	}
+}
+
+// partial is the sidecar record, saved as <cachePath>.part.json, of a download kept in <cachePath>.part.
+type partial struct {
+	URL          string `json:"url"`
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+
+	path string
+}
+
+func partialPath(savePath string) string {
+	return savePath + ".part"
+}
+
+func loadPartial(url string, savePath string) *partial {
+	p := &partial{URL: url, path: partialPath(savePath)}
+
+	content, err := ioutil.ReadFile(p.sidecar())
+	if err != nil {
+		return p
+	}
+
+	var saved partial
+	if json.Unmarshal(content, &saved) != nil || saved.URL != url {
+		return p
+	}
+	p.ETag = saved.ETag
+	p.LastModified = saved.LastModified
+	return p
+}
+
+func (p *partial) sidecar() string {
+	return p.path + ".json"
+}
+
+// validator returns the value of the If-Range header, weak etags can not be used for ranges.
+func (p *partial) validator() string {
+	if len(p.ETag) > 0 && !strings.HasPrefix(p.ETag, "W/") {
+		return p.ETag
+	}
+	return p.LastModified
+}
+
+// offset returns the number of bytes that can be resumed.
+func (p *partial) offset() int64 {
+	if len(p.validator()) == 0 {
+		return 0
+	}
+	info, err := os.Stat(p.path)
+	if err != nil {
+		return 0
+	}
+	return info.Size()
+}
+
+func (p *partial) setRange(req *http.Request, offset int64) {
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	req.Header.Set("If-Range", p.validator())
+}
+
+// update records the validators of resp, it returns false when the response can not be resumed later.
+func (p *partial) update(resp *http.Response) bool {
+	p.ETag = resp.Header.Get("ETag")
+	p.LastModified = resp.Header.Get("Last-Modified")
+	return len(p.validator()) > 0
+}
+
+func (p *partial) save() error {
+	content, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(p.sidecar(), content, 0644)
+}
+
+// open returns the part file to write the body of resp to, a response that is not resumed starts over.
+func (p *partial) open(resp *http.Response, resumed bool) (*os.File, error) {
+	if resumed {
+		return os.OpenFile(p.path, os.O_WRONLY|os.O_APPEND, 0644) // #nosec
+	}
+
+	p.discard()
+	if err := os.MkdirAll(filepath.Dir(p.path), 0750); err != nil {
+		return nil, err
+	}
+	if p.update(resp) {
+		if err := p.save(); err != nil {
+			return nil, err
+		}
+	}
+	return os.OpenFile(p.path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644) // #nosec
+}
+
+func (p *partial) discard() {
+	shouldRemove(p.path)
+	shouldRemove(p.sidecar())
+}
+
+// contentRangeStart returns the first byte position of a Content-Range header, -1 when it is not valid.
+func contentRangeStart(value string) int64 {
+	var start, end int64
+	var total string
+	if _, err := fmt.Sscanf(value, "bytes %d-%d/%s", &start, &end, &total); err != nil {
+		return -1
+	}
+	return start
+}
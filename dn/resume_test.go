@@ -0,0 +1,158 @@
+package dn
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/BakerHub/trivial/fs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type rangeServer struct {
+	mux       sync.Mutex
+	content   string
+	etag      string
+	interrupt int
+	ranges    []string
+}
+
+func (s *rangeServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.Lock()
+	s.ranges = append(s.ranges, r.Header.Get("Range"))
+	interrupt := s.interrupt
+	s.interrupt = 0
+	s.mux.Unlock()
+
+	w.Header().Set("ETag", s.etag)
+	if interrupt > 0 {
+		w.Header().Set("Content-Length", strconv.Itoa(len(s.content)))
+		_, _ = w.Write([]byte(s.content[:interrupt]))
+		w.(http.Flusher).Flush()
+		panic(http.ErrAbortHandler)
+	}
+	http.ServeContent(w, r, "", time.Time{}, strings.NewReader(s.content))
+}
+
+func TestCache_Fetch_resume(t *testing.T) {
+	content := strings.Repeat("0123456789", 100)
+
+	cases := map[string]struct {
+		partETag   string
+		serverETag string
+		part       string
+
+		wantRange string
+	}{
+		"resume": {
+			`"v1"`, `"v1"`, content[:300],
+			"bytes=300-",
+		},
+		"validator changed": {
+			`"v1"`, `"v2"`, "stale content",
+			"bytes=13-",
+		},
+		"weak etag": {
+			`W/"v1"`, `W/"v1"`, content[:300],
+			"",
+		},
+	}
+
+	for name, tc := range cases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			server := &rangeServer{content: content, etag: tc.serverETag}
+			ts := httptest.NewServer(server)
+			defer ts.Close()
+
+			dir := mustTempDir(t)
+			defer os.RemoveAll(dir)
+
+			cachePath := filepath.Join(dir, "big.bin")
+			part := &partial{URL: ts.URL, ETag: tc.partETag, path: partialPath(cachePath)}
+			require.NoError(t, part.save())
+			require.NoError(t, ioutil.WriteFile(part.path, []byte(tc.part), 0644))
+
+			cache := NewCache(filepath.Join(dir, "meta.json"), Resume())
+			cache.Fetch(ts.URL, cachePath)
+			require.NoError(t, cache.Wait())
+
+			assert.Equal(t, []string{tc.wantRange}, server.ranges)
+			assert.Equal(t, content, mustReadFile(t, cachePath))
+			assert.False(t, fs.Exists(part.path))
+			assert.False(t, fs.Exists(part.sidecar()))
+		})
+	}
+}
+
+func TestCache_Fetch_resume_interrupted(t *testing.T) {
+	content := strings.Repeat("0123456789", 100)
+	server := &rangeServer{content: content, etag: `"v1"`, interrupt: 400}
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	dir := mustTempDir(t)
+	defer os.RemoveAll(dir)
+	cachePath := filepath.Join(dir, "big.bin")
+
+	cache := NewCache(filepath.Join(dir, "meta.json"), Resume())
+	cache.Fetch(ts.URL, cachePath)
+	require.Error(t, cache.Wait())
+
+	assert.False(t, fs.Exists(cachePath))
+	assert.Equal(t, content[:400], mustReadFile(t, partialPath(cachePath)))
+	assert.Equal(t, `"v1"`, loadPartial(ts.URL, cachePath).ETag)
+
+	cache = NewCache(filepath.Join(dir, "meta.json"), Resume())
+	cache.Fetch(ts.URL, cachePath)
+	require.NoError(t, cache.Wait())
+
+	assert.Equal(t, []string{"", "bytes=400-"}, server.ranges)
+	assert.Equal(t, content, mustReadFile(t, cachePath))
+	assert.Equal(t, http.StatusOK, cache.Files[ts.URL].Status)
+}
+
+func TestCache_Fetch_interrupted_without_resume(t *testing.T) {
+	server := &rangeServer{content: strings.Repeat("x", 1000), etag: `"v1"`, interrupt: 400}
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	dir := mustTempDir(t)
+	defer os.RemoveAll(dir)
+	cachePath := filepath.Join(dir, "big.bin")
+
+	cache := NewCache(filepath.Join(dir, "meta.json"))
+	cache.Fetch(ts.URL, cachePath)
+	require.Error(t, cache.Wait())
+
+	assert.False(t, fs.Exists(cachePath))
+	assert.False(t, fs.Exists(partialPath(cachePath)))
+}
+
+func TestContentRangeStart(t *testing.T) {
+	assert.Equal(t, int64(300), contentRangeStart("bytes 300-999/1000"))
+	assert.Equal(t, int64(0), contentRangeStart("bytes 0-9/*"))
+	assert.Equal(t, int64(-1), contentRangeStart("items 1-2/3"))
+	assert.Equal(t, int64(-1), contentRangeStart(""))
+}
+
+func TestLoadPartial_otherURL(t *testing.T) {
+	dir := mustTempDir(t)
+	defer os.RemoveAll(dir)
+	cachePath := filepath.Join(dir, "a")
+
+	require.NoError(t, (&partial{URL: "http://a", ETag: `"x"`, path: partialPath(cachePath)}).save())
+	require.NoError(t, ioutil.WriteFile(partialPath(cachePath), bytes.Repeat([]byte("a"), 10), 0644))
+
+	assert.Equal(t, int64(10), loadPartial("http://a", cachePath).offset())
+	assert.Equal(t, int64(0), loadPartial("http://b", cachePath).offset())
+}
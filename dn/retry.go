@@ -0,0 +1,127 @@
+package dn
+
+import (
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// RetryPolicy decides how often and how fast a failed download is tried again.
+type RetryPolicy struct {
+	// MaxAttempts is the total number of tries, 1 or less disables retrying.
+	MaxAttempts int
+	// BaseDelay is the wait before the first retry, it doubles with every further retry.
+	BaseDelay time.Duration
+	// MaxDelay caps the backoff, it does not cap the wait requested by a Retry-After header.
+	MaxDelay time.Duration
+	// Jitter is the fraction, between 0 and 1, of each delay that is randomized.
+	Jitter float64
+	// Retryable reports whether a failure is worth another try, IsRetryable is used when it is nil.
+	Retryable func(err *DownloadError) bool
+}
+
+// DefaultRetryPolicy tries a download up to 3 times with a backoff starting at 500ms.
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts: 3,
+		BaseDelay:   500 * time.Millisecond,
+		MaxDelay:    30 * time.Second,
+		Jitter:      0.2,
+	}
+}
+
+// Retry sets the retry policy of the cache, failed downloads are not retried by default.
+func Retry(policy RetryPolicy) Option {
+	return func(cache *Cache) {
+		cache.retry = policy
+	}
+}
+
+// IsRetryable reports whether err is a transient failure: a network error such as a timeout or a reset
+// connection, a 429 or a 5xx response.
+func IsRetryable(err *DownloadError) bool {
+	switch err.Cause {
+	case CauseNetwork:
+		return true
+	case CauseStatus:
+		status := err.StatusCode()
+		return status == http.StatusTooManyRequests || status >= 500
+	default:
+		return false
+	}
+}
+
+func (policy RetryPolicy) retryable(err *DownloadError) bool {
+	if policy.Retryable != nil {
+		return policy.Retryable(err)
+	}
+	return IsRetryable(err)
+}
+
+// delay returns the wait before the retry following the given attempt, retryAfter wins when it is longer.
+func (policy RetryPolicy) delay(attempt int, retryAfter time.Duration) time.Duration {
+	d := policy.BaseDelay
+	for i := 1; i < attempt && (policy.MaxDelay <= 0 || d < policy.MaxDelay); i++ {
+		d *= 2
+	}
+	if policy.MaxDelay > 0 && d > policy.MaxDelay {
+		d = policy.MaxDelay
+	}
+	if policy.Jitter > 0 {
+		d -= time.Duration(policy.Jitter * rand.Float64() * float64(d)) // #nosec
+	}
+
+	if retryAfter > d {
+		return retryAfter
+	}
+	return d
+}
+
+// parseRetryAfter reads a Retry-After header given either in seconds or as an http date.
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	if len(value) == 0 {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil && date.After(now) {
+		return date.Sub(now)
+	}
+	return 0
+}
+
+func (cache *Cache) downloadWithRetry(t *task) (*download, error) {
+	for attempt := 1; ; attempt++ {
+		result, err := cache.downloadFile(t)
+		if err == nil {
+			result.retries = attempt - 1
+			return result, nil
+		}
+
+		failure, ok := err.(*DownloadError)
+		if !ok {
+			return nil, err
+		}
+		failure.Retries = attempt - 1
+		if attempt >= cache.retry.MaxAttempts || !cache.retry.retryable(failure) {
+			return nil, failure
+		}
+
+		var retryAfter time.Duration
+		if status, ok := failure.Err.(*StatusError); ok {
+			retryAfter = status.RetryAfter
+		}
+		timer := time.NewTimer(cache.retry.delay(attempt, retryAfter))
+		select {
+		case <-timer.C:
+		case <-t.ctx.Done():
+			timer.Stop()
+			return nil, &DownloadError{URL: t.url, Path: t.path, Cause: CauseCanceled, Err: t.ctx.Err(), Retries: failure.Retries}
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package dn
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRetryPolicy_delay(t *testing.T) {
+	policy := RetryPolicy{BaseDelay: 100 * time.Millisecond, MaxDelay: time.Second}
+
+	cases := map[string]struct {
+		attempt    int
+		retryAfter time.Duration
+
+		want time.Duration
+	}{
+		"first":               {1, 0, 100 * time.Millisecond},
+		"second":              {2, 0, 200 * time.Millisecond},
+		"third":               {3, 0, 400 * time.Millisecond},
+		"capped":              {10, 0, time.Second},
+		"retry after longer":  {1, 5 * time.Second, 5 * time.Second},
+		"retry after shorter": {3, 10 * time.Millisecond, 400 * time.Millisecond},
+	}
+
+	for name, tc := range cases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, tc.want, policy.delay(tc.attempt, tc.retryAfter))
+		})
+	}
+}
+
+func TestRetryPolicy_delay_jitter(t *testing.T) {
+	policy := RetryPolicy{BaseDelay: 100 * time.Millisecond, Jitter: 0.5}
+	for i := 0; i < 100; i++ {
+		d := policy.delay(1, 0)
+		assert.True(t, d >= 50*time.Millisecond && d <= 100*time.Millisecond, "delay out of range: %v", d)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2019, 1, 2, 15, 4, 5, 0, time.UTC)
+
+	cases := map[string]struct {
+		value string
+		want  time.Duration
+	}{
+		"empty":    {"", 0},
+		"seconds":  {"120", 2 * time.Minute},
+		"negative": {"-1", 0},
+		"date":     {"Wed, 02 Jan 2019 15:04:35 GMT", 30 * time.Second},
+		"past":     {"Wed, 02 Jan 2019 15:00:00 GMT", 0},
+		"invalid":  {"soon", 0},
+	}
+
+	for name, tc := range cases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, tc.want, parseRetryAfter(tc.value, now))
+		})
+	}
+}
+
+func TestIsRetryable(t *testing.T) {
+	cases := map[string]struct {
+		err  *DownloadError
+		want bool
+	}{
+		"network": {&DownloadError{Cause: CauseNetwork, Err: errors.New("reset")}, true},
+		"disk":    {&DownloadError{Cause: CauseDisk, Err: errors.New("full")}, false},
+		"429":     {&DownloadError{Cause: CauseStatus, Err: &StatusError{StatusCode: 429}}, true},
+		"503":     {&DownloadError{Cause: CauseStatus, Err: &StatusError{StatusCode: 503}}, true},
+		"404":     {&DownloadError{Cause: CauseStatus, Err: &StatusError{StatusCode: 404}}, false},
+	}
+
+	for name, tc := range cases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, tc.want, IsRetryable(tc.err))
+		})
+	}
+}
+
+func TestCache_Fetch_retry(t *testing.T) {
+	cases := map[string]struct {
+		failures int32
+		status   int
+		policy   RetryPolicy
+
+		requests int32
+		retries  int
+		ok       bool
+	}{
+		"recovers": {
+			2, http.StatusServiceUnavailable,
+			RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond},
+			3, 2, true,
+		},
+		"gives up": {
+			5, http.StatusServiceUnavailable,
+			RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond},
+			3, 2, false,
+		},
+		"not retryable": {
+			5, http.StatusNotFound,
+			RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond},
+			1, 0, false,
+		},
+		"custom retryable": {
+			1, http.StatusNotFound,
+			RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, Retryable: func(err *DownloadError) bool {
+				return err.StatusCode() == http.StatusNotFound
+			}},
+			2, 1, true,
+		},
+		"disabled": {
+			1, http.StatusServiceUnavailable,
+			RetryPolicy{},
+			1, 0, false,
+		},
+	}
+
+	for name, tc := range cases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			var requests int32
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if atomic.AddInt32(&requests, 1) <= tc.failures {
+					w.WriteHeader(tc.status)
+					return
+				}
+				_, _ = w.Write([]byte("content"))
+			}))
+			defer server.Close()
+
+			dir := mustTempDir(t)
+			defer os.RemoveAll(dir)
+
+			cache := NewCache(filepath.Join(dir, "meta.json"), Retry(tc.policy))
+			got := cache.Fetch(server.URL, filepath.Join(dir, "a.txt")).Wait()
+			err := cache.Wait()
+
+			assert.Equal(t, tc.requests, atomic.LoadInt32(&requests))
+			assert.Equal(t, tc.retries, got.Retries)
+			if tc.ok {
+				require.NoError(t, err)
+				assert.Equal(t, tc.retries, cache.Files[server.URL].Retries)
+			} else {
+				require.IsType(t, &WaitError{}, err)
+				assert.Equal(t, tc.retries, err.(*WaitError).Failures[0].Retries)
+			}
+		})
+	}
+}
+
+func TestCache_Fetch_retryAfter(t *testing.T) {
+	var first time.Time
+	var waited time.Duration
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if first.IsZero() {
+			first = time.Now()
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		waited = time.Since(first)
+		_, _ = w.Write([]byte("content"))
+	}))
+	defer server.Close()
+
+	dir := mustTempDir(t)
+	defer os.RemoveAll(dir)
+
+	cache := NewCache(filepath.Join(dir, "meta.json"), Retry(RetryPolicy{MaxAttempts: 2, BaseDelay: time.Millisecond}))
+	cache.Fetch(server.URL, filepath.Join(dir, "a.txt"))
+	require.NoError(t, cache.Wait())
+
+	assert.True(t, waited >= time.Second, "Retry-After not honored, waited %v", waited)
+}
@@ -0,0 +1,83 @@
+package dn
+
+import (
+	"net/url"
+	"sync"
+)
+
+type job struct {
+	host string
+	run  func()
+}
+
+// scheduler runs queued jobs in submission order while keeping at most maxActive jobs running overall and at
+// most maxPerHost jobs for one host, a limit of 0 means unlimited. A job that is blocked by its host limit
+// does not hold back jobs for other hosts queued after it.
+type scheduler struct {
+	mux        sync.Mutex
+	maxActive  int
+	maxPerHost int
+	active     int
+	perHost    map[string]int
+	queue      []*job
+}
+
+func newScheduler(maxActive int, maxPerHost int) *scheduler {
+	return &scheduler{
+		maxActive:  maxActive,
+		maxPerHost: maxPerHost,
+		perHost:    make(map[string]int),
+	}
+}
+
+func hostOf(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+	return u.Host
+}
+
+func (s *scheduler) submit(host string, run func()) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	s.queue = append(s.queue, &job{host: host, run: run})
+	s.dispatchLocked()
+}
+
+func (s *scheduler) dispatchLocked() {
+	for i := 0; i < len(s.queue); {
+		if s.maxActive > 0 && s.active >= s.maxActive {
+			return
+		}
+
+		j := s.queue[i]
+		if s.maxPerHost > 0 && s.perHost[j.host] >= s.maxPerHost {
+			i++
+			continue
+		}
+
+		s.queue = append(s.queue[:i], s.queue[i+1:]...)
+		s.active++
+		s.perHost[j.host]++
+		go s.execute(j)
+	}
+}
+
+func (s *scheduler) execute(j *job) {
+	defer s.finish(j)
+	j.run()
+}
+
+func (s *scheduler) finish(j *job) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	s.active--
+	s.perHost[j.host]--
+	if s.perHost[j.host] == 0 {
+		delete(s.perHost, j.host)
+	}
+	s.dispatchLocked()
+}
@@ -0,0 +1,129 @@
+package dn
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type concurrency struct {
+	mux     sync.Mutex
+	active  map[string]int
+	total   int
+	maxHost int
+	maxAll  int
+	order   []int
+}
+
+func (c *concurrency) enter(host string, id int) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	c.active[host]++
+	c.total++
+	c.order = append(c.order, id)
+	if c.active[host] > c.maxHost {
+		c.maxHost = c.active[host]
+	}
+	if c.total > c.maxAll {
+		c.maxAll = c.total
+	}
+}
+
+func (c *concurrency) leave(host string) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	c.active[host]--
+	c.total--
+}
+
+func TestScheduler(t *testing.T) {
+	cases := map[string]struct {
+		maxActive  int
+		maxPerHost int
+		hosts      []string
+
+		wantMaxAll  int
+		wantMaxHost int
+	}{
+		"global limit": {
+			2, 0,
+			[]string{"a", "b", "c", "d", "e", "f"},
+			2, 1,
+		},
+		"host limit": {
+			0, 1,
+			[]string{"a", "a", "a", "b", "b", "b"},
+			2, 1,
+		},
+		"both limits": {
+			3, 2,
+			[]string{"a", "a", "a", "a", "b", "b", "c", "c"},
+			3, 2,
+		},
+		"serial": {
+			1, 0,
+			[]string{"a", "b", "a", "b"},
+			1, 1,
+		},
+	}
+
+	for name, tc := range cases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			c := &concurrency{active: make(map[string]int)}
+			release := make(chan struct{})
+			var wg sync.WaitGroup
+
+			s := newScheduler(tc.maxActive, tc.maxPerHost)
+			for i, host := range tc.hosts {
+				i, host := i, host
+				wg.Add(1)
+				s.submit(host, func() {
+					defer wg.Done()
+					c.enter(host, i)
+					<-release
+					c.leave(host)
+				})
+			}
+			close(release)
+			wg.Wait()
+
+			assert.True(t, c.maxAll <= tc.wantMaxAll, "max concurrent %d > %d", c.maxAll, tc.wantMaxAll)
+			assert.True(t, c.maxHost <= tc.wantMaxHost, "max per host %d > %d", c.maxHost, tc.wantMaxHost)
+			assert.Len(t, c.order, len(tc.hosts))
+		})
+	}
+}
+
+func TestScheduler_order(t *testing.T) {
+	var order []int
+	var wg sync.WaitGroup
+
+	s := newScheduler(1, 0)
+	block := make(chan struct{})
+	wg.Add(1)
+	s.submit("a", func() {
+		defer wg.Done()
+		<-block
+	})
+	for i := 0; i < 10; i++ {
+		i := i
+		wg.Add(1)
+		s.submit("a", func() {
+			defer wg.Done()
+			order = append(order, i)
+		})
+	}
+	close(block)
+	wg.Wait()
+
+	assert.Equal(t, []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}, order)
+}
+
+func TestHostOf(t *testing.T) {
+	assert.Equal(t, "example.com:8080", hostOf("http://example.com:8080/a/b.txt"))
+	assert.Equal(t, "", hostOf("://bad"))
+}
@@ -0,0 +1,286 @@
+package dn
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/BakerHub/trivial/fs"
+)
+
+// hopHeaders are the headers that only concern one connection, they are not stored.
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+func cloneHeader(header http.Header) http.Header {
+	clone := make(http.Header, len(header))
+	for key, values := range header {
+		clone[key] = append([]string(nil), values...)
+	}
+	return clone
+}
+
+// storeHeader keeps the end-to-end headers of a response, the headers of a 304 response update the stored ones.
+func (meta *CacheMeta) storeHeader(header http.Header, notModified bool) {
+	if header == nil {
+		return
+	}
+	if !notModified || meta.Header == nil {
+		meta.Header = make(http.Header, len(header))
+	}
+	for key, values := range header {
+		meta.Header[key] = append([]string(nil), values...)
+	}
+	for _, key := range hopHeaders {
+		meta.Header.Del(key)
+	}
+}
+
+// responseStatus is the status code the stored file is served with.
+func (meta *CacheMeta) responseStatus() int {
+	if meta.Status < 200 || meta.Status > 299 || meta.Status == http.StatusPartialContent {
+		return http.StatusOK
+	}
+	return meta.Status
+}
+
+// Transport is an http.RoundTripper that serves GET responses from a Cache, so that code taking an
+// *http.Client can share the files of the cache. The cache options apply: without Revalidate or Freshness a
+// cached response is served without contacting the server, and an Offline cache fails the requests it
+// can not serve. Other requests are passed to Base.
+//
+// The meta of the stored responses is kept in memory, Cache.Wait saves it to the meta file.
+type Transport struct {
+	// Base sends the requests, http.DefaultTransport when nil.
+	Base http.RoundTripper
+
+	cache *Cache
+	dir   string
+}
+
+// NewTransport returns a Transport storing the response bodies in dir and their meta in cache.
+func NewTransport(cache *Cache, dir string, base http.RoundTripper) *Transport {
+	return &Transport{Base: base, cache: cache, dir: dir}
+}
+
+func (tr *Transport) base() http.RoundTripper {
+	if tr.Base == nil {
+		return http.DefaultTransport
+	}
+	return tr.Base
+}
+
+// pathOf returns where the response body of url is stored.
+func (tr *Transport) pathOf(url string) string {
+	sum := sha256.Sum256([]byte(url))
+	return filepath.Join(tr.dir, hex.EncodeToString(sum[:]))
+}
+
+// cacheable tells whether the response of req may come from the cache, requests that carry their own
+// validators or ranges are left to the caller.
+func cacheable(req *http.Request) bool {
+	if req.Method != http.MethodGet && req.Method != "" {
+		return false
+	}
+	for _, key := range []string{"Range", "If-None-Match", "If-Modified-Since", "If-Match", "If-Unmodified-Since"} {
+		if len(req.Header.Get(key)) > 0 {
+			return false
+		}
+	}
+	_, noStore := parseCacheControl(req.Header.Get("Cache-Control"))["no-store"]
+	return !noStore
+}
+
+// stored returns a copy of the meta of url when its response can be served from cachePath.
+func (tr *Transport) stored(url string, cachePath string) (*CacheMeta, bool) {
+	tr.cache.mux.Lock()
+	defer tr.cache.mux.Unlock()
+
+	meta, ok := tr.cache.Files[url]
+	if !ok || meta.Saved != cachePath || meta.Header == nil || !fs.Exists(cachePath) {
+		return nil, false
+	}
+	meta.AccessedAt = now()
+	stored := *meta
+	return &stored, true
+}
+
+// RoundTrip implements http.RoundTripper.
+func (tr *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	url := req.URL.String()
+	cachePath := tr.pathOf(url)
+	if !cacheable(req) {
+		if tr.cache.offline {
+			return nil, &DownloadError{URL: url, Path: cachePath, Cause: CauseOffline, Err: ErrNotCached}
+		}
+		return tr.base().RoundTrip(req)
+	}
+
+	meta, ok := tr.stored(url, cachePath)
+	if ok && (tr.cache.offline || meta.varyMatches(req.Header) && tr.usable(meta)) {
+		tr.cache.count(Result{URL: url, Path: cachePath, Hit: true})
+		return tr.respond(req, meta)
+	}
+	if tr.cache.offline {
+		return nil, &DownloadError{URL: url, Path: cachePath, Cause: CauseOffline, Err: ErrNotCached}
+	}
+	if ok && !meta.varyMatches(req.Header) {
+		ok = false
+	}
+
+	out := req
+	if ok && (len(meta.ETag) > 0 || len(meta.LastModified) > 0) {
+		out = req.WithContext(req.Context())
+		out.Header = cloneHeader(req.Header)
+		if len(meta.ETag) > 0 {
+			out.Header.Set("If-None-Match", meta.ETag)
+		}
+		if len(meta.LastModified) > 0 {
+			out.Header.Set("If-Modified-Since", meta.LastModified)
+		}
+		tr.cache.countRevalidation()
+	}
+
+	resp, err := tr.base().RoundTrip(out)
+	if ok && tr.staleOnError(meta, resp, err) {
+		if resp != nil {
+			discard(resp.Body)
+		}
+		tr.cache.count(Result{URL: url, Path: cachePath, Hit: true, Stale: true})
+		return tr.respond(req, meta)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	t := &task{url: url, path: cachePath}
+	if out != req && resp.StatusCode == http.StatusNotModified {
+		discard(resp.Body)
+		tr.cache.addMeta(t, &download{
+			status:       resp.StatusCode,
+			etag:         meta.ETag,
+			lastModified: meta.LastModified,
+			notModified:  true,
+			header:       resp.Header,
+			request:      out.Header,
+		})
+		if updated, ok := tr.stored(url, cachePath); ok {
+			meta = updated
+		}
+		tr.cache.count(Result{URL: url, Path: cachePath, Hit: true})
+		return tr.respond(req, meta)
+	}
+
+	if resp.StatusCode != http.StatusOK || noStore(resp.Header) {
+		return resp, nil
+	}
+	return tr.store(req, resp, t)
+}
+
+// usable tells whether a stored response is served without asking the server.
+func (tr *Transport) usable(meta *CacheMeta) bool {
+	switch {
+	case tr.cache.freshness:
+		return !meta.FetchedAt.IsZero() && meta.age(time.Now()) < meta.lifetime()
+	case tr.cache.revalidate:
+		return false
+	}
+	return true
+}
+
+// staleOnError tells whether a stored response replaces a failed one, see StaleIfError.
+func (tr *Transport) staleOnError(meta *CacheMeta, resp *http.Response, err error) bool {
+	if !tr.cache.staleIfError || meta.FetchedAt.IsZero() {
+		return false
+	}
+	if err == nil && resp.StatusCode < 500 {
+		return false
+	}
+	return meta.staleWithin("stale-if-error", time.Now())
+}
+
+// store writes the body of resp to the cache and serves it from there.
+func (tr *Transport) store(req *http.Request, resp *http.Response, t *task) (*http.Response, error) {
+	defer shouldClose(resp.Body)
+
+	file, err := tempFileFor(t.path)
+	if err != nil {
+		return nil, err
+	}
+	defer shouldRemove(file.Name())
+
+	n, err := io.Copy(file, tr.cache.trackProgress(t, resp.Body, 0, resp.ContentLength))
+	if err != nil {
+		shouldClose(file)
+		tr.cache.count(Result{URL: t.url, Path: t.path, Err: err})
+		return nil, err
+	}
+	if err = file.Close(); err != nil {
+		return nil, err
+	}
+	if err = move(file.Name(), t.path); err != nil {
+		return nil, err
+	}
+
+	tr.cache.addMeta(t, &download{
+		status:       resp.StatusCode,
+		bytes:        n,
+		etag:         resp.Header.Get("ETag"),
+		lastModified: resp.Header.Get("Last-Modified"),
+		header:       resp.Header,
+		request:      req.Header,
+	})
+	tr.cache.count(Result{URL: t.url, Path: t.path, Bytes: n})
+
+	meta, ok := tr.stored(t.url, t.path)
+	if !ok {
+		return nil, fmt.Errorf("dn: %s is no longer cached", t.url)
+	}
+	return tr.respond(req, meta)
+}
+
+// respond serves the stored response described by meta.
+func (tr *Transport) respond(req *http.Request, meta *CacheMeta) (*http.Response, error) {
+	file, err := os.Open(meta.Saved) // #nosec
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		shouldClose(file)
+		return nil, err
+	}
+
+	status := meta.responseStatus()
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        cloneHeader(meta.Header),
+		Body:          file,
+		ContentLength: info.Size(),
+		Request:       req,
+	}, nil
+}
+
+func discard(body io.ReadCloser) {
+	_, _ = io.Copy(ioutil.Discard, body)
+	shouldClose(body)
+}
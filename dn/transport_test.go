@@ -0,0 +1,186 @@
+package dn
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/BakerHub/trivial/fs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func transportGet(t *testing.T, client *http.Client, url string) (*http.Response, string) {
+	resp, err := client.Get(url)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return resp, string(body)
+}
+
+func TestTransport(t *testing.T) {
+	cases := map[string]struct {
+		options      []Option
+		cacheControl string
+
+		requests    int32
+		conditional int32
+	}{
+		"cached": {
+			nil,
+			"",
+			1,
+			0,
+		},
+		"revalidate": {
+			[]Option{Revalidate()},
+			"",
+			2,
+			1,
+		},
+		"fresh": {
+			[]Option{Freshness()},
+			"max-age=3600",
+			1,
+			0,
+		},
+		"stale": {
+			[]Option{Freshness()},
+			"max-age=0",
+			2,
+			1,
+		},
+		"no store": {
+			[]Option{Freshness()},
+			"no-store",
+			2,
+			0,
+		},
+	}
+
+	for name, tc := range cases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			var requests, conditional int32
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				atomic.AddInt32(&requests, 1)
+				w.Header().Set("ETag", `"v1"`)
+				w.Header().Set("X-Served", "origin")
+				if len(tc.cacheControl) > 0 {
+					w.Header().Set("Cache-Control", tc.cacheControl)
+				}
+				if r.Header.Get("If-None-Match") == `"v1"` {
+					atomic.AddInt32(&conditional, 1)
+					w.WriteHeader(http.StatusNotModified)
+					return
+				}
+				_, _ = w.Write([]byte("content"))
+			}))
+			defer server.Close()
+
+			dir := mustTempDir(t)
+			defer os.RemoveAll(dir)
+
+			cache := NewCache(filepath.Join(dir, "meta.json"), tc.options...)
+			client := &http.Client{Transport: NewTransport(cache, filepath.Join(dir, "files"), nil)}
+			url := server.URL + "/a.txt"
+
+			for i := 0; i < 2; i++ {
+				resp, body := transportGet(t, client, url)
+				assert.Equal(t, http.StatusOK, resp.StatusCode)
+				assert.Equal(t, "content", body)
+				assert.Equal(t, "origin", resp.Header.Get("X-Served"))
+			}
+			assert.Equal(t, tc.requests, atomic.LoadInt32(&requests))
+			assert.Equal(t, tc.conditional, atomic.LoadInt32(&conditional))
+
+			assert.False(t, fs.Exists(filepath.Join(dir, "meta.json")), "the meta is saved by Wait")
+			require.NoError(t, cache.Wait())
+			reloaded := NewCache(filepath.Join(dir, "meta.json"))
+			meta, ok := reloaded.Files[url]
+			if tc.cacheControl == "no-store" {
+				assert.False(t, ok)
+				return
+			}
+			require.True(t, ok)
+			assert.Equal(t, "origin", meta.Header.Get("X-Served"))
+			assert.Equal(t, `"v1"`, meta.ETag)
+		})
+	}
+}
+
+func TestTransport_passThrough(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if r.URL.Path == "/missing" {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = w.Write([]byte(r.Method))
+	}))
+	defer server.Close()
+
+	dir := mustTempDir(t)
+	defer os.RemoveAll(dir)
+
+	cache := NewCache(filepath.Join(dir, "meta.json"))
+	client := &http.Client{Transport: NewTransport(cache, dir, nil)}
+
+	for i := 0; i < 2; i++ {
+		resp, err := client.Post(server.URL, "text/plain", strings.NewReader("body"))
+		require.NoError(t, err)
+		resp.Body.Close()
+
+		resp, _ = transportGet(t, client, server.URL+"/missing")
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	}
+	assert.Equal(t, int32(4), atomic.LoadInt32(&requests))
+	assert.Empty(t, cache.Files)
+}
+
+func TestTransport_header(t *testing.T) {
+	meta := &CacheMeta{}
+	meta.storeHeader(http.Header{"Etag": {`"v1"`}, "Connection": {"close"}, "X-A": {"a"}}, false)
+	assert.Equal(t, http.Header{"Etag": {`"v1"`}, "X-A": {"a"}}, meta.Header)
+
+	meta.storeHeader(http.Header{"X-B": {"b"}}, true)
+	assert.Equal(t, http.Header{"Etag": {`"v1"`}, "X-A": {"a"}, "X-B": {"b"}}, meta.Header)
+
+	meta.storeHeader(http.Header{"X-C": {"c"}}, false)
+	assert.Equal(t, http.Header{"X-C": {"c"}}, meta.Header)
+}
+
+func TestTransport_offline(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		_, _ = w.Write([]byte("content"))
+	}))
+	defer server.Close()
+
+	dir := mustTempDir(t)
+	defer os.RemoveAll(dir)
+
+	metaFile := filepath.Join(dir, "meta.json")
+	online := NewCache(metaFile)
+	client := &http.Client{Transport: NewTransport(online, dir, nil)}
+	transportGet(t, client, server.URL+"/a")
+	require.NoError(t, online.Wait())
+
+	client = &http.Client{Transport: NewTransport(NewCache(metaFile, Offline()), dir, nil)}
+	_, body := transportGet(t, client, server.URL+"/a")
+	assert.Equal(t, "content", body)
+
+	_, err := client.Get(server.URL + "/b")
+	assert.Error(t, err)
+	_, err = client.Post(server.URL+"/a", "text/plain", strings.NewReader("body"))
+	assert.Error(t, err)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&requests))
+}
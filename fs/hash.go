@@ -3,6 +3,7 @@ package fs
 import (
 	"crypto/md5" // #nosec
 	"crypto/sha1"	// #nosec
+	"crypto/sha256"
 	"encoding/hex"
 	"hash"
 	"io"
@@ -50,3 +51,7 @@ func (fh *FileHash) FromFile(path string) (string, error) {
 
 	return r, nil
 }
+
+func NewFileHashSHA256() *FileHash {
+	return &FileHash{sha256.New()}
+}
@@ -7,14 +7,35 @@ import (
 	"strings"
 )
 
-func Run(name string, args ...string) {
+// RunError is a command that failed, with its combined output.
+type RunError struct {
+	Command string
+	Output  []byte
+	Err     error
+}
+
+func (e *RunError) Error() string {
+	return fmt.Sprintf("%s: %v\n%s", e.Command, e.Err, e.Output)
+}
+
+// Exec runs a command and returns a *RunError when it fails.
+func Exec(name string, args ...string) error {
 	cmd := exec.Command(name, args...) // #nosec
 	out, err := cmd.CombinedOutput()
 
 	if err != nil {
-		fmt.Printf("%s %s", name, strings.Join(args, " "))
-		fmt.Printf("%s\n", out)
-		check.Check(err)
+		return &RunError{Command: fmt.Sprintf("%s %s", name, strings.Join(args, " ")), Output: out, Err: err}
+	}
+	return nil
+}
+
+func Run(name string, args ...string) {
+	err := Exec(name, args...)
+
+	if e, ok := err.(*RunError); ok {
+		fmt.Printf("%s", e.Command)
+		fmt.Printf("%s\n", e.Output)
+		check.Check(e.Err)
 	}
 }
 
@@ -22,6 +43,6 @@ type Shell struct {
 
 }
 
-func (r *Shell) Run(name string, args ...string)  {
-	Run(name, args...)
+func (r *Shell) Run(name string, args ...string) error {
+	return Exec(name, args...)
 }
@@ -17,5 +17,14 @@ func TestRunPanic(t *testing.T) {
 
 func TestShell_Run(t *testing.T) {
 	s := &Shell{}
-	s.Run("ls", ".")
+	assert.NoError(t, s.Run("ls", "."))
+}
+
+func TestShell_Run_error(t *testing.T) {
+	s := &Shell{}
+	err := s.Run("sh", "-c", "echo failed; exit 3")
+
+	assert.IsType(t, &RunError{}, err)
+	assert.Equal(t, "sh -c echo failed; exit 3", err.(*RunError).Command)
+	assert.Equal(t, "failed\n", string(err.(*RunError).Output))
 }